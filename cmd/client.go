@@ -20,7 +20,7 @@ func main() {
 		fmt.Println("Failed to dial rpc server:", err)
 		return
 	}
-	var arg lotsawa.CompileArgs = lotsawa.CompileArgs{"abc", "c"}
+	var arg lotsawa.CompileArgs = lotsawa.CompileArgs{Code: "abc", Lang: "c"}
 	var res lotsawa.CompileReply
 	err = s.Compile(&arg, &res)
 
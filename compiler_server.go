@@ -4,9 +4,13 @@ package lotsawa
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fluter01/lotsawa/lang"
@@ -20,19 +24,32 @@ type Request struct {
 	args *CompileArgs
 	// channel to receive compiler's result
 	chRes chan *lang.Result
+	// test cases to judge the program against, and their results
+	cases   []TestCase
+	results []CaseResult
+	// the sandbox the code runs in
+	isolation string
 }
 
 // Compiler server
 type CompilerServer struct {
 	chReq  chan *Request
 	chExit chan bool
+	conf   *Config
 
 	compilers map[string]lang.Compiler
+	// the sandboxes in use, by name, and the default one
+	sandboxes map[string]lang.Sandbox
+	sandbox   lang.Sandbox
+
+	mu      sync.Mutex
+	removed int
 }
 
-func NewCompilerServer() *CompilerServer {
+func NewCompilerServer(conf *Config) *CompilerServer {
 	s := new(CompilerServer)
 
+	s.conf = conf
 	s.chReq = make(chan *Request)
 	s.chExit = make(chan bool)
 	s.compilers = make(map[string]lang.Compiler)
@@ -42,11 +59,27 @@ func NewCompilerServer() *CompilerServer {
 	s.AddCompiler("C11", new(lang.C11))
 	s.AddCompiler("C99", new(lang.C99))
 	s.AddCompiler("C89", new(lang.C89))
+	s.AddCompiler("Clang", new(lang.Clang))
 	// alias sh to bash
 	s.AddCompiler("sh", new(lang.Bash))
 	s.AddCompiler("Bash", new(lang.Bash))
 	s.AddCompiler("Go", new(lang.Go))
 	s.AddCompiler("Golang", new(lang.Go))
+	s.AddCompiler("Java", new(lang.Java))
+	// alias kt to kotlin
+	s.AddCompiler("kt", new(lang.Kotlin))
+	s.AddCompiler("Kotlin", new(lang.Kotlin))
+	s.AddCompiler("js", new(lang.Node))
+	s.AddCompiler("JavaScript", new(lang.Node))
+	s.AddCompiler("Node", new(lang.Node))
+	s.AddCompiler("ts", new(lang.TypeScript))
+	s.AddCompiler("TypeScript", new(lang.TypeScript))
+	// asm defaults to GAS without libc
+	s.AddCompiler("asm", new(lang.GAS))
+	s.AddCompiler("GAS", new(lang.GAS))
+	s.AddCompiler("GAS-libc", new(lang.GASLibc))
+	s.AddCompiler("NASM", new(lang.NASM))
+	s.AddCompiler("NASM-libc", new(lang.NASMLibc))
 
 	return s
 }
@@ -75,10 +108,76 @@ func (s *CompilerServer) ListCompiler() []string {
 	return keys
 }
 
+// workspace returns the directory of job id, failing if it has expired
+func (s *CompilerServer) workspace(id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return "", errors.New("invalid id " + id)
+	}
+
+	for _, c := range s.compilers {
+		dir := lang.Workspace(c, id)
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		_, err = os.Stat(dir + keepSuffix)
+		kept := err == nil
+		if !kept && time.Since(fi.ModTime()) > s.conf.FetchExpiry {
+			return "", errors.New("workspace " + id + " expired")
+		}
+		return dir, nil
+	}
+	return "", errors.New("workspace " + id + " not found")
+}
+
+// ListFiles returns the files in the workspace of job id.
+func (s *CompilerServer) ListFiles(id string) ([]lang.File, error) {
+	dir, err := s.workspace(id)
+	if err != nil {
+		return nil, err
+	}
+	return lang.ListWorkspace(dir)
+}
+
+// ReadFile returns the content of a file in the workspace of job id.
+func (s *CompilerServer) ReadFile(id, name string) ([]byte, error) {
+	dir, err := s.workspace(id)
+	if err != nil {
+		return nil, err
+	}
+	files, err := lang.ListWorkspace(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// only what the listing shows can be read, links are left out
+	name = filepath.Clean(name)
+	for _, f := range files {
+		if f.Name != name {
+			continue
+		}
+		if f.Size > s.conf.MaxFetchSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes",
+				name, s.conf.MaxFetchSize)
+		}
+		return ioutil.ReadFile(filepath.Join(dir, name))
+	}
+	return nil, errors.New(name + " not found")
+}
+
 func (s *CompilerServer) Init() error {
 	var err error
 	var cnt int
 
+	err = s.loadDefinitions()
+	if err != nil {
+		log.Printf("could not load language definitions: %s", err)
+	}
+	err = s.loadPlugins()
+	if err != nil {
+		log.Printf("could not load plugins: %s", err)
+	}
+
 	for name, comp := range s.compilers {
 		err = comp.Init()
 		if err != nil {
@@ -113,10 +212,185 @@ func (s *CompilerServer) Init() error {
 		}
 	}
 
-	err = lang.InitContainer()
+	return s.initSandboxes()
+}
+
+// newSandbox returns the named sandbox, the compilers configured to use
+// the same sandbox share it
+func (s *CompilerServer) newSandbox(name string) (lang.Sandbox, error) {
+	sb, ok := s.sandboxes[name]
+	if ok {
+		return sb, nil
+	}
+	sb, err := lang.NewSandbox(name)
 	if err != nil {
-		log.Printf("container init failed: %s", err)
-		log.Printf("will use unrestricted host execution")
+		return nil, fmt.Errorf("%s sandbox: %s", name, err)
+	}
+	s.sandboxes[name] = sb
+	return sb, nil
+}
+
+// give the compilers the sandbox configured for them, or the default
+// one, which is the most isolated available unless configured
+func (s *CompilerServer) initSandboxes() error {
+	var sb lang.Sandbox
+	var err error
+
+	names := []string{lang.SandboxContainer, lang.SandboxNamespaces,
+		lang.SandboxHost}
+	switch s.conf.Isolation {
+	case "", IsolationFallback, IsolationRequired:
+		if s.conf.Sandbox != "" {
+			names = []string{s.conf.Sandbox}
+		}
+	case IsolationHost:
+		if s.conf.Sandbox != "" && s.conf.Sandbox != lang.SandboxHost {
+			return errors.New("the " + s.conf.Sandbox +
+				" sandbox can not isolate code run on the host only")
+		}
+		names = []string{lang.SandboxHost}
+	default:
+		return errors.New("unknown isolation " + s.conf.Isolation)
+	}
+
+	s.sandboxes = make(map[string]lang.Sandbox)
+	for _, name := range names {
+		sb, err = s.newSandbox(name)
+		if err == nil {
+			break
+		}
+		if len(names) == 1 {
+			return err
+		}
+		log.Printf("could not init the sandbox: %s", err)
+	}
+	s.sandbox = sb
+	if sb.Name() == lang.SandboxHost && len(names) > 1 {
+		log.Printf("no sandbox available, the code will run on the host")
+	} else {
+		log.Printf("will use the %s sandbox", sb.Name())
+	}
+
+	for _, comp := range s.compilers {
+		if c, ok := comp.(lang.Sandboxed); ok {
+			c.SetSandbox(sb)
+		}
+	}
+	// the aliases of a language may share its compiler, the sandboxes
+	// configured by name are set last to override the default
+	for name, sbName := range s.conf.Sandboxes {
+		c, ok := s.GetCompiler(name).(lang.Sandboxed)
+		if !ok {
+			log.Printf("%s does not run in a sandbox", name)
+			continue
+		}
+		if s.conf.Isolation == IsolationHost && sbName != lang.SandboxHost {
+			return errors.New("the " + sbName +
+				" sandbox can not isolate code run on the host only")
+		}
+		sb, err = s.newSandbox(sbName)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s will use the %s sandbox", name, sb.Name())
+		c.SetSandbox(sb)
+	}
+
+	if s.conf.Isolation != IsolationRequired || len(s.conf.Isolated) > 0 {
+		return nil
+	}
+	for name, comp := range s.compilers {
+		if isolation(comp) == lang.SandboxHost && !s.trusted(comp) {
+			return errors.New("isolation is required, but " + name +
+				" would run on the host")
+		}
+	}
+	return nil
+}
+
+// isolation returns the sandbox isolating what the compiler runs, the
+// compilers without one run on the host
+func isolation(c lang.Compiler) string {
+	if sc, ok := c.(lang.Sandboxed); ok {
+		return sc.Sandbox().Name()
+	}
+	return lang.SandboxHost
+}
+
+// refuses reports whether the compiler must not run the code, for it
+// is not isolated while its language requires isolation
+func (s *CompilerServer) refuses(c lang.Compiler) bool {
+	if s.conf.Isolation != IsolationRequired ||
+		isolation(c) != lang.SandboxHost || s.trusted(c) {
+		return false
+	}
+	for _, name := range s.conf.Isolated {
+		if s.GetCompiler(name) == c {
+			return true
+		}
+	}
+	return false
+}
+
+// trusted reports whether the compiler is a plugin trusted to isolate
+// the code itself
+func (s *CompilerServer) trusted(c lang.Compiler) bool {
+	if _, ok := c.(*lang.Plugin); !ok {
+		return false
+	}
+	for _, name := range s.conf.Trusted {
+		if s.GetCompiler(name) == c {
+			return true
+		}
+	}
+	return false
+}
+
+// register the languages defined under lang.LanguageDir
+func (s *CompilerServer) loadDefinitions() error {
+	defs, err := lang.LoadDefinitions(lang.LanguageDir)
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		names := append([]string{def.Name()}, def.Aliases()...)
+		taken := ""
+		for _, name := range names {
+			if s.GetCompiler(name) != nil {
+				taken = name
+				break
+			}
+		}
+		if taken != "" {
+			log.Printf("skipping definition of %s: %s is already a compiler",
+				def.Name(), taken)
+			continue
+		}
+		for _, name := range names {
+			s.AddCompiler(name, def)
+		}
+	}
+	return nil
+}
+
+// register the plugins found under lang.PluginDir, a plugin is named
+// after its executable or socket file
+func (s *CompilerServer) loadPlugins() error {
+	files, err := ioutil.ReadDir(lang.PluginDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		path := filepath.Join(lang.PluginDir, fi.Name())
+		name := strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))
+		if fi.Mode()&os.ModeSocket != 0 {
+			s.AddCompiler(name, lang.DialPlugin("unix", path))
+		} else if fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			s.AddCompiler(name, lang.NewPlugin(path))
+		}
 	}
 	return nil
 }
@@ -124,12 +398,21 @@ func (s *CompilerServer) Init() error {
 func (s *CompilerServer) Loop() {
 	var req *Request
 	var stop bool = false
+	var tick <-chan time.Time
 	log.Println("Compile server running")
+	if s.conf.Retention.Interval > 0 {
+		ticker := time.NewTicker(s.conf.Retention.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	for !stop {
 		select {
 		case req = <-s.chReq:
 			s.handle(req)
 			break
+		case <-tick:
+			s.collect()
+			break
 		case stop = <-s.chExit:
 			break
 		}
@@ -142,19 +425,110 @@ func (s *CompilerServer) handle(req *Request) {
 	var res *lang.Result
 
 	c = s.GetCompiler(req.args.Lang)
+	if req.args.Build != "" {
+		// a build command is run as a shell script
+		c = s.GetCompiler("bash")
+	}
+
+	req.isolation = s.sandbox.Name()
+	if c != nil {
+		req.isolation = isolation(c)
+	}
 
 	if c == nil {
 		res = &lang.Result{
 			Error: "Language not supported.",
 		}
+	} else if s.refuses(c) {
+		res = &lang.Result{
+			Error: "Language not available without a sandbox.",
+		}
+	} else if args, err := s.compileArgs(c, req.args); err != nil {
+		res = &lang.Result{
+			Error: err.Error(),
+		}
 	} else {
-		res = c.Compile(req.args.Code)
+		if req.cases != nil {
+			res, req.results = s.judge(c, args, req.cases)
+		} else {
+			res = c.Compile(args)
+		}
+		lang.Explain(res.Diagnostics)
+		if req.args.Keep && res.Id != "" {
+			if err := s.keep(c, res.Id); err != nil {
+				log.Printf("could not keep %s: %s", res.Id, err)
+			}
+		}
 	}
 
 	req.chRes <- res
 	return
 }
 
+// compileArgs checks the request and prepares the compiler's arguments
+func (s *CompilerServer) compileArgs(c lang.Compiler,
+	args *CompileArgs) (*lang.Args, error) {
+	if ft, ok := c.(lang.FlagTaker); len(args.Flags) > 0 &&
+		!(ok && ft.TakesFlags()) {
+		return nil, errors.New(c.Name() + " does not take flags")
+	}
+	err := s.conf.Flags.Check(args.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	code, files, entryDir := args.Code, args.Files, ""
+	if len(args.Archive) > 0 {
+		files, err = s.conf.Archive.Extract(args.Archive)
+		if err != nil {
+			return nil, err
+		}
+		if files == nil {
+			files = make(map[string]string)
+		}
+		for name, content := range args.Files {
+			files[name] = content
+		}
+	}
+	if args.Entry != "" && args.Build == "" {
+		// the entry moves from the files to the code, the compilers
+		// look up what it includes in its directory
+		entry := filepath.Clean(args.Entry)
+		entryDir = filepath.Dir(entry)
+		rest := make(map[string]string)
+		found := false
+		for name, content := range files {
+			if filepath.Clean(name) == entry {
+				code, found = content, true
+			} else {
+				rest[name] = content
+			}
+		}
+		if !found {
+			return nil, errors.New("entry " + args.Entry + " not found")
+		}
+		files = rest
+	}
+	if args.Build != "" {
+		code = args.Build
+	}
+
+	return &lang.Args{
+		Code:  code,
+		Mode:  lang.Mode(args.Mode),
+		Opt:   args.Opt,
+		Intel: args.Intel,
+		Flags: args.Flags,
+		Files: files,
+		Bench: args.Bench,
+		Race:  args.Race,
+		Cover: args.Cover,
+
+		EntryDir: entryDir,
+		Build:    args.Build != "",
+	}, nil
+}
+
 func (s *CompilerServer) Submit(req *Request) {
 	s.chReq <- req
 }
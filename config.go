@@ -0,0 +1,82 @@
+// Copyright 2016 Alex Fluter
+
+package lotsawa
+
+import (
+	"time"
+
+	"github.com/fluter01/lotsawa/lang"
+)
+
+// Config holds the settings of the server
+type Config struct {
+	// The compiler flags users are allowed to pass
+	Flags lang.FlagPolicy
+
+	// Limits of uploaded archives
+	Archive lang.ArchiveLimits
+
+	// Max size of a file fetched from a workspace, in bytes
+	MaxFetchSize int64
+
+	// How long the files of a workspace can be fetched after the
+	// workspace was last written
+	FetchExpiry time.Duration
+
+	// Bounds of the workspaces left in the data store
+	Retention Retention
+
+	// The sandbox running the compilers and the programs: "container",
+	// "namespaces" or "host". The most isolated available one is used
+	// if empty.
+	Sandbox string
+
+	// The sandboxes of some compilers, by compiler name, overriding
+	// Sandbox
+	Sandboxes map[string]string
+
+	// Whether the code may run on the host when no sandbox isolates it:
+	// IsolationFallback, IsolationRequired or IsolationHost
+	Isolation string
+
+	// The languages refusing to run without a sandbox under
+	// IsolationRequired, the others run on the host. The server fails
+	// to start instead if it is empty and a language runs on the host.
+	Isolated []string
+
+	// The plugins trusted to isolate the code they run themselves, the
+	// others run it on the host as far as IsolationRequired knows
+	Trusted []string
+}
+
+// The isolation policies
+const (
+	// IsolationFallback runs the code on the host when no sandbox is
+	// available
+	IsolationFallback = "fallback"
+	// IsolationRequired runs the code of the languages in Isolated, or
+	// of all of them if it is empty, only in a sandbox or in a trusted
+	// plugin
+	IsolationRequired = "required"
+	// IsolationHost runs the code on the host only, for trusted code
+	IsolationHost = "host"
+)
+
+// DefaultConfig returns the settings used by NewServer
+func DefaultConfig() *Config {
+	return &Config{
+		Flags:        lang.DefaultFlagPolicy,
+		Archive:      lang.DefaultArchiveLimits,
+		MaxFetchSize: 1 << 20,
+		FetchExpiry:  24 * time.Hour,
+		Isolation:    IsolationFallback,
+		Retention: Retention{
+			MaxAge:   24 * time.Hour,
+			MaxSize:  1 << 30,
+			MaxCount: 10000,
+			Interval: 10 * time.Minute,
+
+			MaxCacheSize: 256 << 20,
+		},
+	}
+}
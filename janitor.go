@@ -0,0 +1,225 @@
+// Copyright 2016 Alex Fluter
+
+package lotsawa
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fluter01/lotsawa/lang"
+)
+
+const (
+	// suffix of the marker file of a kept workspace
+	keepSuffix = ".keep"
+	// suffix of the overlay work directory of a workspace
+	workSuffix = "-work"
+)
+
+// Retention bounds the workspaces left in the data store, a zero
+// bound is unlimited. Workspaces kept on request are never removed and
+// not counted.
+type Retention struct {
+	// Remove workspaces older than this
+	MaxAge time.Duration
+	// Remove the oldest workspaces past this total size, in bytes
+	MaxSize int64
+	// Remove the oldest workspaces past this number
+	MaxCount int
+	// How often to collect the workspaces
+	Interval time.Duration
+	// Remove the least recently used builds past this total size of
+	// the build cache, in bytes
+	MaxCacheSize int64
+}
+
+// Usage of the data store
+type Usage struct {
+	// Number of workspaces
+	Workspaces int
+	// Number of workspaces kept on request
+	Kept int
+	// Total size of the workspaces, in bytes
+	Size int64
+	// Number of workspaces removed since the server started
+	Removed int
+}
+
+type workspaceInfo struct {
+	path  string
+	size  int64
+	mtime time.Time
+	kept  bool
+}
+
+// scan the data store for workspaces and leftover overlay work dirs
+func scanStore() ([]workspaceInfo, []string, error) {
+	var spaces []workspaceInfo
+	var works []string
+
+	entries, err := ioutil.ReadDir(lang.DataStore)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]bool)
+	for _, fi := range entries {
+		names[fi.Name()] = true
+	}
+
+	for _, fi := range entries {
+		name := fi.Name()
+		path := filepath.Join(lang.DataStore, name)
+		if !fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, workSuffix) {
+			works = append(works, path)
+			continue
+		}
+		spaces = append(spaces, workspaceInfo{
+			path:  path,
+			size:  dirSize(path),
+			mtime: fi.ModTime(),
+			kept:  names[name+keepSuffix],
+		})
+	}
+	return spaces, works, nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// collect removes the workspaces past the retention bounds, oldest
+// first. It runs in the server loop, so no job is using them.
+func (s *CompilerServer) collect() {
+	r := s.conf.Retention
+
+	spaces, works, err := scanStore()
+	if err != nil {
+		log.Printf("could not scan data store: %s", err)
+		return
+	}
+	sort.Slice(spaces, func(i, j int) bool {
+		return spaces[i].mtime.Before(spaces[j].mtime)
+	})
+
+	var count int
+	var size int64
+	for _, ws := range spaces {
+		if !ws.kept {
+			count++
+			size += ws.size
+		}
+	}
+
+	removed := 0
+	for _, ws := range spaces {
+		if ws.kept {
+			continue
+		}
+		if (r.MaxAge == 0 || time.Since(ws.mtime) <= r.MaxAge) &&
+			(r.MaxCount == 0 || count <= r.MaxCount) &&
+			(r.MaxSize == 0 || size <= r.MaxSize) {
+			continue
+		}
+		err = os.RemoveAll(ws.path)
+		if err != nil {
+			log.Printf("could not remove %s: %s", ws.path, err)
+			continue
+		}
+		count--
+		size -= ws.size
+		removed++
+	}
+
+	// runContainer removes its work dir, unless it did not get to
+	for _, work := range works {
+		err = os.RemoveAll(work)
+		if err != nil {
+			log.Printf("could not remove %s: %s", work, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.removed += removed
+	s.mu.Unlock()
+	if removed > 0 {
+		log.Printf("removed %d workspaces", removed)
+	}
+
+	if r.MaxCacheSize > 0 {
+		trimCache(r.MaxCacheSize)
+	}
+}
+
+// trimCache removes the least recently used builds until the build
+// cache fits in max bytes
+func trimCache(max int64) {
+	entries, err := ioutil.ReadDir(lang.CacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("could not scan build cache: %s", err)
+		}
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	var size int64
+	for _, fi := range entries {
+		size += fi.Size()
+	}
+	for _, fi := range entries {
+		if size <= max {
+			break
+		}
+		path := filepath.Join(lang.CacheDir, fi.Name())
+		err = os.Remove(path)
+		if err != nil {
+			log.Printf("could not remove %s: %s", path, err)
+			continue
+		}
+		size -= fi.Size()
+	}
+}
+
+// keep exempts the workspace of job id run by c from collection
+func (s *CompilerServer) keep(c lang.Compiler, id string) error {
+	return ioutil.WriteFile(lang.Workspace(c, id)+keepSuffix, nil, 0664)
+}
+
+// Usage returns the current usage of the data store.
+func (s *CompilerServer) Usage() (*Usage, error) {
+	spaces, _, err := scanStore()
+	if err != nil {
+		return nil, err
+	}
+
+	var u Usage
+	for _, ws := range spaces {
+		u.Workspaces++
+		u.Size += ws.size
+		if ws.kept {
+			u.Kept++
+		}
+	}
+	s.mu.Lock()
+	u.Removed = s.removed
+	s.mu.Unlock()
+	return &u, nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2016 Alex Fluter
+
+package lotsawa
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fluter01/lotsawa/lang"
+)
+
+// Verdicts of a test case
+const (
+	Accepted            = "AC"
+	WrongAnswer         = "WA"
+	TimeLimitExceeded   = "TLE"
+	RuntimeError        = "RE"
+	MemoryLimitExceeded = "MLE"
+)
+
+// Ways to compare the output of a test case with the expected one
+const (
+	CompareExact      = "exact"
+	CompareWhitespace = "whitespace"
+	CompareFloat      = "float"
+	CompareRegex      = "regex"
+)
+
+// Default tolerance of the float comparison
+const DefaultTolerance = 1e-6
+
+// Largest output kept from a test case for comparison
+const MaxCaseOutput = 1024 * 1024
+
+type TestCase struct {
+	// The program's standard input
+	Stdin string
+	// The program's arguments
+	Args []string
+	// The expected standard output
+	Expected string
+	// How the output is compared: "exact" by default, "whitespace"
+	// to ignore the spacing, "float" to compare numbers within
+	// Tolerance, or "regex" to match the output against Expected
+	Compare string
+	// Absolute or relative tolerance of the float comparison
+	Tolerance float64
+	// Memory limit of the program in megabytes, no more than
+	// lang.MemoryLimit, which is also the default
+	Memory int
+}
+
+type JudgeArgs struct {
+	CompileArgs
+	// The cases the program is run against
+	Cases []TestCase
+}
+
+type CaseResult struct {
+	// AC, WA, TLE, RE or MLE
+	Verdict string
+	// Time took to run the case
+	Time time.Duration
+	// The program's standard output and standard error
+	Output string
+	Error  string
+	// Where the output differs from the expected one
+	Diff string
+}
+
+type JudgeReply struct {
+	// Unique compiling ID
+	Id string
+	// The command line used to compile this piece of code
+	Cmd string
+	// Why the code could not be judged
+	Error string
+	// Compiler's standard output
+	C_Output string
+	// Compiler's standard error
+	C_Error string
+	// The errors and warnings of the compiler
+	Diagnostics []lang.Diagnostic
+	// Result of each test case, in order
+	Cases []CaseResult
+	// Time took to compile and run all cases
+	Time time.Duration
+	// The sandbox the code ran in
+	Isolation string
+}
+
+// judge builds the code once and runs it against each test case. The
+// plugins run the code as they compile it, they can not be judged.
+func (s *CompilerServer) judge(c lang.Compiler, args *lang.Args,
+	cases []TestCase) (*lang.Result, []CaseResult) {
+	b, ok := c.(lang.Builder)
+	if !ok {
+		return &lang.Result{
+			Error: c.Name() + " programs can not be judged.",
+		}, nil
+	}
+	if args.Mode != lang.ModeRun {
+		return &lang.Result{
+			Error: "Judging needs a program to run.",
+		}, nil
+	}
+
+	prog, res := b.Build(args)
+	if prog == nil {
+		if res.Error == "" {
+			res.Error = "No program to run."
+		}
+		return res, nil
+	}
+
+	results := make([]CaseResult, len(cases))
+	for i := range cases {
+		results[i] = runCase(prog, &cases[i])
+	}
+	return res, results
+}
+
+// runCase runs the program with the input of the case and checks its
+// output
+func runCase(prog *lang.Program, tc *TestCase) CaseResult {
+	var cr CaseResult
+	var stdout, stderr capWriter
+
+	stdout.max, stderr.max = MaxCaseOutput, lang.MaxLength
+	memory := tc.Memory
+	if memory <= 0 || memory > lang.MemoryLimit {
+		memory = lang.MemoryLimit
+	}
+	start := time.Now()
+	err := prog.RunLimited(strings.NewReader(tc.Stdin), tc.Args,
+		&stdout, &stderr, lang.RunTimeout*time.Second, memory)
+	cr.Time = time.Now().Sub(start)
+	cr.Output = truncate(stdout.String())
+	cr.Error = stderr.String()
+
+	switch {
+	case lang.IsTimeout(err):
+		cr.Verdict = TimeLimitExceeded
+	case lang.IsOutOfMemory(err):
+		cr.Verdict = MemoryLimitExceeded
+		cr.Error = err.Error()
+	case lang.IsDisallowed(err):
+		cr.Verdict = RuntimeError
+		cr.Error = err.Error()
+	case err != nil:
+		cr.Verdict = RuntimeError
+		if cr.Error == "" {
+			cr.Error = err.Error()
+		}
+	default:
+		cr.Diff, err = compareOutput(tc, stdout.String())
+		if err != nil {
+			cr.Verdict = RuntimeError
+			cr.Error = err.Error()
+		} else if stdout.truncated {
+			cr.Verdict = WrongAnswer
+			cr.Diff = "output too long"
+		} else if cr.Diff != "" {
+			cr.Verdict = WrongAnswer
+		} else {
+			cr.Verdict = Accepted
+		}
+	}
+	return cr
+}
+
+// compareOutput returns where the output differs from the expected one,
+// empty if they match
+func compareOutput(tc *TestCase, output string) (string, error) {
+	switch tc.Compare {
+	case "", CompareExact:
+		return diffLines(strings.Split(tc.Expected, "\n"),
+			strings.Split(output, "\n"), nil), nil
+	case CompareWhitespace:
+		return diffLines(strings.Fields(tc.Expected),
+			strings.Fields(output), nil), nil
+	case CompareFloat:
+		tol := tc.Tolerance
+		if tol <= 0 {
+			tol = DefaultTolerance
+		}
+		return diffLines(strings.Fields(tc.Expected),
+			strings.Fields(output), func(a, b string) bool {
+				return floatEqual(a, b, tol)
+			}), nil
+	case CompareRegex:
+		re, err := regexp.Compile(tc.Expected)
+		if err != nil {
+			return "", errors.New("bad expected output: " + err.Error())
+		}
+		if !re.MatchString(output) {
+			return fmt.Sprintf("output does not match %q", tc.Expected), nil
+		}
+		return "", nil
+	default:
+		return "", errors.New("unknown comparison: " + tc.Compare)
+	}
+}
+
+// diffLines describes the first difference of the two lists of lines
+// or tokens, eq compares them, they must be equal if it is nil
+func diffLines(expected, got []string, eq func(a, b string) bool) string {
+	for i := 0; i < len(expected) || i < len(got); i++ {
+		if i >= len(got) {
+			return fmt.Sprintf("%d: expected %q, got nothing",
+				i+1, truncate(expected[i]))
+		}
+		if i >= len(expected) {
+			return fmt.Sprintf("%d: expected nothing, got %q",
+				i+1, truncate(got[i]))
+		}
+		if expected[i] == got[i] || eq != nil && eq(expected[i], got[i]) {
+			continue
+		}
+		return fmt.Sprintf("%d: expected %q, got %q",
+			i+1, truncate(expected[i]), truncate(got[i]))
+	}
+	return ""
+}
+
+// floatEqual compares two numbers within an absolute or relative
+// tolerance
+func floatEqual(a, b string, tol float64) bool {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+	d := math.Abs(x - y)
+	return d <= tol || d <= tol*math.Max(math.Abs(x), math.Abs(y))
+}
+
+func truncate(s string) string {
+	if len(s) <= lang.MaxLength {
+		return s
+	}
+	return s[:lang.MaxLength] + "..."
+}
+
+// capWriter keeps the first max bytes written to it
+type capWriter struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (w *capWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := w.max - w.Len(); len(p) > room {
+		p = p[:room]
+		w.truncated = true
+	}
+	w.Buffer.Write(p)
+	return n, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// ArchiveLimits bounds what is accepted from an uploaded archive
+type ArchiveLimits struct {
+	// Max size of the archive and of all its extracted files, in bytes
+	MaxSize int64
+	// Max number of files in the archive
+	MaxFiles int
+	// Max length of a file path in the archive
+	MaxPath int
+}
+
+// DefaultArchiveLimits allows small projects of a few hundred files.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxSize:  4 << 20,
+	MaxFiles: 256,
+	MaxPath:  128,
+}
+
+// Extract returns the files of a tar, tar.gz or zip archive keyed by
+// their path. Links, devices and paths leaving the workspace are
+// refused.
+func (l *ArchiveLimits) Extract(data []byte) (map[string]string, error) {
+	if int64(len(data)) > l.MaxSize {
+		return nil, errors.New("archive too large")
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return l.extractZip(data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return l.extractTar(r)
+	default:
+		return l.extractTar(bytes.NewReader(data))
+	}
+}
+
+func (l *ArchiveLimits) extractTar(r io.Reader) (map[string]string, error) {
+	var x extraction
+
+	x.limits = l
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad archive: %s", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+			err = x.add(hdr.Name, tr)
+		default:
+			err = fmt.Errorf("%s: not a regular file", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x.files, nil
+}
+
+func (l *ArchiveLimits) extractZip(data []byte) (map[string]string, error) {
+	var x extraction
+
+	x.limits = l
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad archive: %s", err)
+	}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			return nil, fmt.Errorf("%s: not a regular file", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = x.add(f.Name, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x.files, nil
+}
+
+// extraction keeps the count of what has been extracted so far
+type extraction struct {
+	limits *ArchiveLimits
+	files  map[string]string
+	size   int64
+}
+
+func (x *extraction) add(name string, r io.Reader) error {
+	if len(name) > x.limits.MaxPath || !isLocalPath(name) {
+		return fmt.Errorf("invalid file path %s", name)
+	}
+	if len(x.files) >= x.limits.MaxFiles {
+		return errors.New("too many files in archive")
+	}
+
+	// do not trust the sizes in the headers
+	left := x.limits.MaxSize - x.size
+	data, err := ioutil.ReadAll(io.LimitReader(r, left+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > left {
+		return errors.New("archive content too large")
+	}
+	x.size += int64(len(data))
+
+	if x.files == nil {
+		x.files = make(map[string]string)
+	}
+	x.files[filepath.Clean(name)] = string(data)
+	return nil
+}
@@ -0,0 +1,295 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// _start:
+// main:
+
+const (
+	startPtn   = "(?m)^\\s*_start\\s*:"
+	asmMainPtn = "(?m)^\\s*main\\s*:"
+)
+
+var (
+	startRe   = regexp.MustCompile(startPtn)
+	asmMainRe = regexp.MustCompile(asmMainPtn)
+)
+
+// The base assembler for x86-64 assembly language
+type ASMBase struct {
+	sandboxed
+	path     string
+	linker   string
+	objdump  string
+	options  []string
+	loptions []string
+	doptions []string
+	entry    *regexp.Regexp
+	fsrc     string
+	fobj     string
+	fbin     string
+}
+
+// Init looks up the assembler, the linker is set up by linkStatic or
+// linkLibc.
+func (a *ASMBase) Init(as string) error {
+	var path string
+	var err error
+
+	path, err = exec.LookPath(as)
+	if err != nil {
+		return err
+	}
+	a.path = path
+
+	path, err = exec.LookPath("objdump")
+	if err != nil {
+		return err
+	}
+	a.objdump = path
+
+	a.options = []string{}
+	a.doptions = []string{"-d"}
+	a.fobj = "prog.o"
+	a.fbin = "prog"
+	return nil
+}
+
+// link with ld, the program starts at _start and has no libc
+func (a *ASMBase) linkStatic() error {
+	path, err := exec.LookPath("ld")
+	if err != nil {
+		return err
+	}
+	a.linker = path
+	a.loptions = []string{}
+	a.entry = startRe
+	return nil
+}
+
+// link with gcc, the program starts at main and can call into libc
+func (a *ASMBase) linkLibc() error {
+	path, err := exec.LookPath("gcc")
+	if err != nil {
+		return err
+	}
+	a.linker = path
+	a.loptions = []string{"-no-pie", "-z", "noexecstack"}
+	a.entry = asmMainRe
+	return nil
+}
+
+func (a *ASMBase) Version() string {
+	var stdOut bytes.Buffer
+
+	err := runLocal(a.path, []string{"--version"}, ".", nil, &stdOut, nil)
+	if err != nil {
+		log.Println("error exec ", a.path, ":", err)
+		return ""
+	}
+	return stdOut.String()
+}
+
+// command is the command line of the tool at path, as shown in the result
+func (a *ASMBase) command(path string, args []string) string {
+	return strings.Join(append([]string{filepath.Base(path)}, args...), " ")
+}
+
+func (a *ASMBase) compile(caller Compiler, req *Args) *Result {
+	prog, result := a.build(caller, req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, prog.Name+": ", result)
+}
+
+// build assembles and links the code, the program is nil if it failed
+// or if there is no entry point, the object is listed instead then
+func (a *ASMBase) build(caller Compiler, req *Args) (*Program, *Result) {
+	var err error
+	var stdOut bytes.Buffer
+	var stdErr bytes.Buffer
+	var result Result
+	var dir string
+	var id string
+	var args []string
+
+	if caller == nil {
+		return nil, nil
+	}
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(caller, req.Mode)
+	}
+	dir, id, err = setupWorkspace(caller, a.fsrc, req.Code, req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	args = append(a.options[:len(a.options):len(a.options)],
+		"-o", a.fobj, a.fsrc)
+	err = a.runBuild(a.path, args, nil, nil, dir, nil, &stdOut, &stdErr)
+	result.Cmd = a.command(a.path, args)
+	result.C_Output, result.C_Error =
+		getStringBuffer(&stdOut), getStringBuffer(&stdErr)
+	if err != nil {
+		result.Error = "assembler: " + err.Error()
+		return nil, &result
+	}
+
+	if !a.entry.MatchString(req.Code) {
+		// nothing to run, list the assembled object instead
+		var listing bytes.Buffer
+
+		args = append(a.doptions[:len(a.doptions):len(a.doptions)], a.fobj)
+		err = a.runBuild(a.objdump, args, nil, nil, dir, nil, &listing,
+			&stdErr)
+		result.Artifact = getArtifactBuffer(&listing)
+		result.C_Error = getStringBuffer(&stdErr)
+		if err != nil {
+			result.Error = "objdump: " + err.Error()
+		}
+		return nil, &result
+	}
+
+	stdOut.Reset()
+	stdErr.Reset()
+	args = append(a.loptions[:len(a.loptions):len(a.loptions)],
+		"-o", a.fbin, a.fobj)
+	err = a.runBuild(a.linker, args, nil, nil, dir, nil, &stdOut, &stdErr)
+	result.Cmd += "; " + a.command(a.linker, args)
+	result.C_Output, result.C_Error =
+		getStringBuffer(&stdOut), getStringBuffer(&stdErr)
+	if err != nil {
+		result.Error = "linker: " + err.Error()
+		return nil, &result
+	}
+
+	return &Program{sandboxed: a.sandboxed,
+		Dir: dir, Id: id, Name: fmt.Sprintf("./%s", a.fbin),
+		Seccomp: SeccompStrict}, &result
+}
+
+// Assemble AT&T syntax with GNU as, link with ld without libc
+type GAS struct {
+	ASMBase
+}
+
+func (a *GAS) Name() string {
+	return "GAS-x86_64"
+}
+
+func (a *GAS) Init() error {
+	if err := a.ASMBase.Init("as"); err != nil {
+		return err
+	}
+	a.options = []string{"--64"}
+	a.fsrc = "prog.s"
+	return a.linkStatic()
+}
+
+func (a *GAS) Compile(req *Args) *Result {
+	return a.compile(a, req)
+}
+
+func (a *GAS) Build(req *Args) (*Program, *Result) {
+	return a.build(a, req)
+}
+
+// Assemble AT&T syntax with GNU as, link against libc with gcc
+type GASLibc struct {
+	GAS
+}
+
+func (a *GASLibc) Name() string {
+	return "GAS-x86_64-libc"
+}
+
+func (a *GASLibc) Init() error {
+	if err := a.GAS.Init(); err != nil {
+		return err
+	}
+	return a.linkLibc()
+}
+
+func (a *GASLibc) Compile(req *Args) *Result {
+	return a.compile(a, req)
+}
+
+func (a *GASLibc) Build(req *Args) (*Program, *Result) {
+	return a.build(a, req)
+}
+
+// Assemble Intel syntax with nasm, link with ld without libc
+type NASM struct {
+	ASMBase
+}
+
+func (a *NASM) Name() string {
+	return "NASM-x86_64"
+}
+
+func (a *NASM) Version() string {
+	var stdOut bytes.Buffer
+
+	err := runLocal(a.path, []string{"-v"}, ".", nil, &stdOut, nil)
+	if err != nil {
+		log.Println("error exec ", a.path, ":", err)
+		return ""
+	}
+	return stdOut.String()
+}
+
+func (a *NASM) Init() error {
+	if err := a.ASMBase.Init("nasm"); err != nil {
+		return err
+	}
+	a.options = []string{"-f", "elf64"}
+	a.doptions = []string{"-d", "-M", "intel"}
+	a.fsrc = "prog.asm"
+	return a.linkStatic()
+}
+
+func (a *NASM) Compile(req *Args) *Result {
+	return a.compile(a, req)
+}
+
+func (a *NASM) Build(req *Args) (*Program, *Result) {
+	return a.build(a, req)
+}
+
+// Assemble Intel syntax with nasm, link against libc with gcc
+type NASMLibc struct {
+	NASM
+}
+
+func (a *NASMLibc) Name() string {
+	return "NASM-x86_64-libc"
+}
+
+func (a *NASMLibc) Init() error {
+	if err := a.NASM.Init(); err != nil {
+		return err
+	}
+	return a.linkLibc()
+}
+
+func (a *NASMLibc) Compile(req *Args) *Result {
+	return a.compile(a, req)
+}
+
+func (a *NASMLibc) Build(req *Args) (*Program, *Result) {
+	return a.build(a, req)
+}
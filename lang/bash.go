@@ -4,14 +4,16 @@ package lang
 
 import (
 	"bytes"
-	"fmt"
 	"log"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Bash struct {
+	sandboxed
 	path string
 	fsrc string
 }
@@ -21,7 +23,7 @@ func (sh *Bash) Name() string {
 }
 
 func (sh *Bash) Version() string {
-	res := sh.Compile("echo $BASH_VERSION")
+	res := sh.Compile(&Args{Code: "echo $BASH_VERSION"})
 	if res.Error != "" {
 		return "Unknown"
 	}
@@ -42,41 +44,85 @@ func (sh *Bash) Init() error {
 	return nil
 }
 
-func (sh *Bash) Compile(code string) *Result {
-	var result Result
+func (sh *Bash) Compile(req *Args) *Result {
 	var err error
 	var stdout, stderr bytes.Buffer
-	var args []string
+
+	prog, result := sh.Build(req)
+	if prog == nil {
+		return result
+	}
+
+	err = prog.Run(nil, nil, &stdout, &stderr, RunTimeout*time.Second)
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+		return result
+	}
+	result.P_Output = getStringBuffer(&stdout)
+	result.P_Error = getStringBuffer(&stderr)
+	return result
+}
+
+// Build writes the script to the workspace, the arguments of the
+// program are passed to it as positional parameters.
+func (sh *Bash) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
 	var dir string
 	var id string
 
-	dir, id, err = createWorkspace(sh)
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(sh, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(sh, sh.fsrc, code, req.Files)
 	result.Id = id
 	if err != nil {
-		return &Result{Error: err.Error()}
+		return nil, &Result{Error: err.Error()}
 	}
 
-	srcpath := fmt.Sprintf("%s/%s", dir, sh.fsrc)
-	err = writeSource(srcpath, code)
+	// check the syntax before running any of it
+	var stderr bytes.Buffer
+	err = sh.runBuild(sh.path, []string{"-n", sh.fsrc}, nil, nil, dir, nil,
+		nil, &stderr)
 	if err != nil {
-		return &Result{Error: err.Error()}
+		result.Cmd = "bash -n " + sh.fsrc
+		result.Error = "bash: " + err.Error()
+		result.Diagnostics = bashDiagnostics(stderr.String())
+		result.C_Error = getStringBuffer(&stderr)
+		return nil, &result
 	}
 
-	args = []string{"-c", code}
-	err = runTimed(sh.path,
-		args,
-		dir,
-		nil,
-		&stdout,
-		&stderr,
-		RunTimeout*time.Second)
-	if err != nil {
-		log.Println(err)
-		result.Error = err.Error()
-		return &result
+	// the strict profile is for C programs, the shell looks its user up
+	// as it starts, which glibc asks nscd or systemd over unix sockets.
+	// The sandboxes leave it no network and no sockets of the host.
+	args := []string{"-c", code, sh.fsrc}
+	result.Cmd = strings.Join(args[:2], " ")
+	return &Program{sandboxed: sh.sandboxed,
+		Dir: dir, Id: id, Name: sh.path, Args: args,
+		Seccomp: SeccompRuntime, Build: req.Build}, &result
+}
+
+// prog.sh: line 3: syntax error near unexpected token `}'
+var bashDiagRe = regexp.MustCompile(`^(.+?): line (\d+): (.*)$`)
+
+func bashDiagnostics(out string) []Diagnostic {
+	var diags []Diagnostic
+
+	for _, line := range strings.Split(out, "\n") {
+		m := bashDiagRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     n,
+			Severity: "error",
+			Message:  m[3],
+		})
 	}
-	result.Cmd = strings.Join(args, " ")
-	result.P_Output = getStringBuffer(&stdout)
-	result.P_Error = getStringBuffer(&stderr)
-	return &result
+	return diags
 }
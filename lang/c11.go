@@ -70,6 +70,10 @@ func (c *C11) Init() error {
 	return nil
 }
 
-func (c *C11) Compile(code string) *Result {
-	return c.compile(c, code, c.prelude)
+func (c *C11) Compile(req *Args) *Result {
+	return c.compile(c, req, c.prelude)
+}
+
+func (c *C11) Build(req *Args) (*Program, *Result) {
+	return c.build(c, req, c.prelude)
 }
@@ -51,6 +51,10 @@ func (c *C89) Init() error {
 	return nil
 }
 
-func (c *C89) Compile(code string) *Result {
-	return c.compile(c, code, c.prelude)
+func (c *C89) Compile(req *Args) *Result {
+	return c.compile(c, req, c.prelude)
+}
+
+func (c *C89) Build(req *Args) (*Program, *Result) {
+	return c.build(c, req, c.prelude)
 }
@@ -59,6 +59,10 @@ func (c *C99) Init() error {
 	return nil
 }
 
-func (c *C99) Compile(code string) *Result {
-	return c.compile(c, code, c.prelude)
+func (c *C99) Compile(req *Args) *Result {
+	return c.compile(c, req, c.prelude)
+}
+
+func (c *C99) Build(req *Args) (*Program, *Result) {
+	return c.build(c, req, c.prelude)
 }
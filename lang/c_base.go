@@ -5,11 +5,12 @@ package lang
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 )
 
 const ()
@@ -27,9 +28,18 @@ const mainPtn = "(int|void)\\s+main\\s*\\("
 
 var mainRe = regexp.MustCompile(mainPtn)
 
+// -O, -O0 .. -O3, -Os, -Og, -Ofast
+const optPtn = "^(-O[0-3sg]?|-Ofast)?$"
+
+var optRe = regexp.MustCompile(optPtn)
+
 // The base compiler for C language
 type CBase struct {
+	sandboxed
+	cc      string
+	llvm    bool
 	path    string
+	version string
 	prelude string
 	options []string
 	fsrc    string
@@ -45,11 +55,15 @@ func (c *CBase) Init() error {
 	var path string
 	var err error
 
-	path, err = exec.LookPath("gcc")
+	if c.cc == "" {
+		c.cc = "gcc"
+	}
+	path, err = exec.LookPath(c.cc)
 	if err != nil {
 		return err
 	}
 	c.path = path
+	c.version = c.Version()
 
 	c.options = []string{}
 	c.prelude = ""
@@ -74,7 +88,20 @@ func (c *CBase) Version() string {
 	return stdOut.String()
 }
 
-func (c *CBase) compile(caller Compiler, code, prelude string) *Result {
+func (c *CBase) compile(caller Compiler, req *Args, prelude string) *Result {
+	if req.Mode == ModeTest {
+		return c.test(caller, req, prelude)
+	}
+	prog, result := c.build(caller, req, prelude)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, prog.Name+": ", result)
+}
+
+// build compiles the code, the program is nil if it failed or if there
+// is nothing to run
+func (c *CBase) build(caller Compiler, req *Args, prelude string) (*Program, *Result) {
 	var err error
 	var srcReader *bytes.Reader
 	var stdOut bytes.Buffer
@@ -85,17 +112,15 @@ func (c *CBase) compile(caller Compiler, code, prelude string) *Result {
 	var srcFile, objFile, execFile string
 	var args []string
 
-	if caller == nil {
-		return nil
-	}
 	dir, id, err = createWorkspace(caller)
 	result.Id = id
 	if err != nil {
 		log.Println("Failed to setup workspace:", err)
 		result.Error = err.Error()
-		return &result
+		return nil, &result
 	}
 
+	code := req.Code
 	srcReader = bytes.NewReader([]byte(prelude + code))
 
 	srcFile, objFile, execFile =
@@ -103,51 +128,187 @@ func (c *CBase) compile(caller Compiler, code, prelude string) *Result {
 		fmt.Sprintf("./%s", c.fobj),
 		fmt.Sprintf("./%s", c.fbin)
 
-	err = writeSource(srcFile, code)
+	err = writeFiles(dir, req.Files)
+	if err == nil {
+		err = writeSource(srcFile, code)
+	}
 	if err != nil {
 		log.Println("Failed to write source:", err)
 		result.Error = err.Error()
-		return &result
+		return nil, &result
+	}
+	if req.Mode != ModeRun {
+		return nil, c.produce(caller, req, dir, srcReader, &result)
+	}
+
+	// the code goes through stdin after the prelude, the other
+	// translation units are compiled from their files
+	var stdin io.Reader = srcReader
+	units := listFiles(req.Files, ".c", false)
+	inputs := []string{"-xc", "-"}
+	if len(units) > 0 {
+		inputs = append([]string{"-xc", "-", "-xnone"}, units...)
+		if code == "" {
+			inputs, stdin = units, nil
+		}
 	}
 	main := c.detectMain(code)
+	for _, unit := range units {
+		main = main || c.detectMain(req.Files[unit])
+	}
 
-	if !main {
-		args = append(c.options, "-xc", "-o", objFile, "-c", "-")
+	options := c.flags(req)
+	if !main && len(units) > 0 {
+		// gcc names the objects after the units
+		args = append(append(options, "-c"), inputs...)
 
-		err = runLocal(c.path, args, dir, srcReader, &stdOut, &stdErr)
-		result.Cmd = strings.Join(args, " ")
-		result.C_Output, result.C_Error =
-			getStringBuffer(&stdOut), getStringBuffer(&stdErr)
+		err = c.runBuild(c.path, args, nil, nil, dir, stdin, &stdOut, &stdErr)
+		result.Cmd = c.command(args)
+		result.C_Output = getStringBuffer(&stdOut)
+		c.diagnose(&result, &stdErr)
 		if err != nil {
-			result.Error = "gcc: " + err.Error()
-			return &result
+			result.Error = c.cc + ": " + err.Error()
+			return nil, &result
 		}
-	} else {
-		args = append(c.options, "-xc", "-o", execFile, "-")
+	} else if !main {
+		args = append(options, "-xc", "-o", objFile, "-c", "-")
 
-		err = runLocal(c.path, args, dir, srcReader, &stdOut, &stdErr)
-		result.Cmd = strings.Join(args, " ")
-		result.C_Output, result.C_Error =
-			getStringBuffer(&stdOut), getStringBuffer(&stdErr)
+		err = c.runBuild(c.path, args, nil, nil, dir, srcReader,
+			&stdOut, &stdErr)
+		result.Cmd = c.command(args)
+		result.C_Output = getStringBuffer(&stdOut)
+		c.diagnose(&result, &stdErr)
 		if err != nil {
-			result.Error = "gcc: " + err.Error()
-			return &result
+			result.Error = c.cc + ": " + err.Error()
+			return nil, &result
 		}
+	} else {
+		args = append(append(options, "-o", execFile), inputs...)
+		result.Cmd = c.command(args)
 
-		var execOut, execErr bytes.Buffer
+		key := cacheKey(caller, c.version, args, prelude+code, req.Files)
+		binFile := filepath.Join(dir, c.fbin)
+		if cacheLoad(key, binFile, &result) {
+			result.Cached = true
+			return &Program{sandboxed: c.sandboxed,
+				Dir: dir, Id: id, Name: execFile,
+				Seccomp: SeccompStrict}, &result
+		}
 
-		err = runTimed(execFile, nil, dir, nil,
-			&execOut, &execErr, RunTimeout*time.Second)
+		err = c.runBuild(c.path, args, nil, nil, dir, stdin, &stdOut, &stdErr)
+		result.C_Output = getStringBuffer(&stdOut)
+		c.diagnose(&result, &stdErr)
 		if err != nil {
-			log.Println("error run:", err)
-			result.Error = execFile + ": " + err.Error()
+			result.Error = c.cc + ": " + err.Error()
+			return nil, &result
+		}
+		cacheStore(key, binFile, &result)
+		return &Program{sandboxed: c.sandboxed,
+			Dir: dir, Id: id, Name: execFile,
+			Seccomp: SeccompStrict}, &result
+	}
+
+	return nil, &result
+}
+
+// produce the assembly, preprocessed source or IR of the code instead
+// of running it
+func (c *CBase) produce(caller Compiler, req *Args, dir string,
+	src io.Reader, result *Result) *Result {
+	var err error
+	var stdOut bytes.Buffer
+	var stdErr bytes.Buffer
+	var args []string
+
+	if !optRe.MatchString(req.Opt) {
+		result.Error = "invalid optimization level " + req.Opt
+		return result
+	}
+
+	// sanitizers and libraries only clutter the output
+	for _, opt := range c.options {
+		if !strings.HasPrefix(opt, "-fsanitize") &&
+			!strings.HasPrefix(opt, "-l") {
+			args = append(args, opt)
 		}
+	}
+	if req.Opt != "" {
+		args = append(args, req.Opt)
+	}
+	args = append(args, c.include(req)...)
 
-		result.P_Output, result.P_Error =
-			getStringBuffer(&execOut), getStringBuffer(&execErr)
+	switch req.Mode {
+	case ModeAssembly:
+		args = append(args, "-S")
+		if req.Intel {
+			args = append(args, "-masm=intel")
+		}
+	case ModePreprocess:
+		args = append(args, "-E")
+	case ModeLLVM:
+		if !c.llvm {
+			return unsupportedMode(caller, req.Mode)
+		}
+		args = append(args, "-S", "-emit-llvm")
+	default:
+		return unsupportedMode(caller, req.Mode)
+	}
+	args = append(args, "-xc", "-o", "-", "-")
+
+	err = c.runBuild(c.path, args, nil, nil, dir, src, &stdOut, &stdErr)
+	result.Cmd = c.command(args)
+	c.diagnose(result, &stdErr)
+	if err != nil {
+		result.Error = c.cc + ": " + err.Error()
+		return result
 	}
 
-	return &result
+	if req.Mode == ModePreprocess {
+		// drop the expanded prelude, the code starts at its #line 1
+		out := stdOut.Bytes()
+		if i := bytes.LastIndex(out, []byte("\n# 1 \"<stdin>\"\n")); i >= 0 {
+			stdOut.Next(i + 1)
+		}
+	}
+	result.Artifact = getArtifactBuffer(&stdOut)
+	return result
+}
+
+// TakesFlags reports that the user's flags are passed to the compiler
+func (c *CBase) TakesFlags() bool {
+	return true
+}
+
+// flags returns the options of the compiler followed by the user's
+func (c *CBase) flags(req *Args) []string {
+	options := c.options[:len(c.options):len(c.options)]
+	if !c.llvm {
+		options = append(options, "-fdiagnostics-format=json")
+	}
+	return append(options, c.include(req)...)
+}
+
+// include returns the user's flags after the directory of the entry,
+// where the headers it includes are
+func (c *CBase) include(req *Args) []string {
+	if req.EntryDir == "" || req.EntryDir == "." {
+		return req.Flags
+	}
+	return append([]string{"-iquote", req.EntryDir}, req.Flags...)
+}
+
+// diagnose parses the diagnostics of the compiler into the result, the
+// code it reads from stdin is reported as the source file
+func (c *CBase) diagnose(result *Result, stderr *bytes.Buffer) {
+	diags, text := gccDiagnostics(stderr.Bytes())
+	renameDiagnostics(diags, "<stdin>", c.fsrc, nil)
+	result.Diagnostics = diags
+	result.C_Error = getStringBuffer(bytes.NewBufferString(text))
+}
+
+// the command line as it is run
+func (c *CBase) command(args []string) string {
+	return strings.Join(append([]string{c.cc}, args...), " ")
 }
 
 func (c *CBase) detectMain(code string) bool {
@@ -0,0 +1,159 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// cacheKey hashes everything a built program depends on: the compiler
+// and its version, the command line, the code and the other files.
+func cacheKey(c Compiler, version string, args []string, code string,
+	files map[string]string) string {
+	h := sha256.New()
+	// length prefixes keep the fields apart
+	field := func(s string) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+
+	field(c.Name())
+	field(version)
+	field(fmt.Sprint(len(args)))
+	for _, arg := range args {
+		field(arg)
+	}
+	field(code)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	field(fmt.Sprint(len(names)))
+	for _, name := range names {
+		field(name)
+		field(files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func cachePath(key string) string {
+	return filepath.Join(CacheDir, key)
+}
+
+// the compiler output stored next to the program of key
+func cacheOutputPath(key string) string {
+	return cachePath(key) + ".out"
+}
+
+// cacheOutput is what the compiler printed while building a cached
+// program, a hit returns it as if the program was just built
+type cacheOutput struct {
+	C_Output    string
+	C_Error     string
+	Diagnostics []Diagnostic
+}
+
+// cacheLoad copies the program built for key to dst and restores the
+// compiler output in result, it reports whether the program was in the
+// cache.
+func cacheLoad(key, dst string, result *Result) bool {
+	var out cacheOutput
+
+	path := cachePath(key)
+	data, err := ioutil.ReadFile(cacheOutputPath(key))
+	if err == nil {
+		err = json.Unmarshal(data, &out)
+	}
+	if err == nil {
+		err = copyFile(path, dst)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to load cached build:", err)
+		}
+		return false
+	}
+	result.C_Output, result.C_Error = out.C_Output, out.C_Error
+	result.Diagnostics = out.Diagnostics
+	// the janitor removes the least recently used entries
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	os.Chtimes(cacheOutputPath(key), now, now)
+	return true
+}
+
+// cacheStore saves the program at src as the build for key, with the
+// compiler output in result
+func cacheStore(key, src string, result *Result) {
+	err := os.MkdirAll(CacheDir, 0775)
+	if err != nil {
+		log.Println("Failed to create build cache:", err)
+		return
+	}
+	data, err := json.Marshal(&cacheOutput{
+		C_Output:    result.C_Output,
+		C_Error:     result.C_Error,
+		Diagnostics: result.Diagnostics,
+	})
+	if err == nil {
+		err = cacheWrite(cachePath(key), func(tmp string) error {
+			return copyFile(src, tmp)
+		})
+	}
+	if err == nil {
+		// the output goes last, an entry without it is a miss
+		err = cacheWrite(cacheOutputPath(key), func(tmp string) error {
+			return ioutil.WriteFile(tmp, data, 0664)
+		})
+	}
+	if err != nil {
+		log.Println("Failed to store build:", err)
+	}
+}
+
+// cacheWrite writes the file at path through a temporary file, readers
+// never see a partial entry
+func cacheWrite(path string, write func(tmp string) error) error {
+	tmp, err := ioutil.TempFile(CacheDir, ".tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	err = write(tmp.Name())
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
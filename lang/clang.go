@@ -0,0 +1,26 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+// Compile as C11 with clang
+type Clang struct {
+	C11
+}
+
+func (c *Clang) Name() string {
+	return "Clang-C11"
+}
+
+func (c *Clang) Init() error {
+	c.cc = "clang"
+	c.llvm = true
+	return c.C11.Init()
+}
+
+func (c *Clang) Compile(req *Args) *Result {
+	return c.compile(c, req, c.prelude)
+}
+
+func (c *Clang) Build(req *Args) (*Program, *Result) {
+	return c.build(c, req, c.prelude)
+}
@@ -2,6 +2,8 @@
 
 package lang
 
+import "time"
+
 // Compiler is the interface that represents a compiler.
 // Each compiler implements this interface, and registers
 // itself to the compiler server to serve client's request.
@@ -18,8 +20,54 @@ type Compiler interface {
 	// The compiler server will ignore this compiler if Init() failed.
 	Init() error
 
-	// Compile the code given as a string
-	Compile(string) *Result
+	// Compile the code given in the arguments
+	Compile(*Args) *Result
+}
+
+// Mode selects what a compiling request produces
+type Mode string
+
+const (
+	// Compile and run the program, the default
+	ModeRun Mode = ""
+	// Produce the assembly code
+	ModeAssembly Mode = "asm"
+	// Produce the preprocessed source
+	ModePreprocess Mode = "preprocess"
+	// Produce the LLVM intermediate representation
+	ModeLLVM Mode = "llvm-ir"
+	// Run the tests, benchmarks and examples in the code
+	ModeTest Mode = "test"
+)
+
+// Struct holds the arguments of a compiling request
+type Args struct {
+	// The code to compile
+	Code string
+	// What to produce, defaults to running the program
+	Mode Mode
+	// Optimization level of the produced code, such as "-O2"
+	Opt string
+	// Use intel syntax for the assembly code
+	Intel bool
+	// Extra compiler flags, only given to the compilers implementing
+	// FlagTaker
+	Flags []string
+	// Other files of the program, keyed by their path relative to
+	// the workspace
+	Files map[string]string
+	// The directory of the file the code comes from in Files, the files
+	// the code includes are looked up there too
+	EntryDir string
+	// The code is a shell command building and running the program, it
+	// runs with the limits of the builds
+	Build bool
+	// Benchmarks to run in test mode, a regular expression
+	Bench string
+	// Run the tests with the race detector
+	Race bool
+	// Report the coverage of the tests
+	Cover bool
 }
 
 // Struct hold the compiling result
@@ -38,6 +86,26 @@ type Result struct {
 	P_Output string
 	// The program's standard output, if compiled successfully and run
 	P_Error string
+	// The assembly, preprocessed source or IR produced instead of
+	// running the program
+	Artifact string
+	// Whether the program came from the build cache
+	Cached bool
+	// Outcome of each test, in test mode
+	Tests []TestResult
+	// The errors and warnings of the compiler
+	Diagnostics []Diagnostic
+}
+
+// TestResult is the outcome of a test, benchmark or example
+type TestResult struct {
+	Name string
+	// "pass", "fail" or "skip"
+	Outcome string
+	// Time took to run the test
+	Time time.Duration
+	// What the test printed
+	Output string
 }
 
 const (
@@ -45,9 +113,47 @@ const (
 	// Any produced files by the program are also placed under it.
 	DataStore = "store"
 
+	// The directory caching built programs by the hash of their
+	// source.
+	CacheDir = "cache"
+
+	// The directory of the build and module caches shared by the Go
+	// builds.
+	GoCacheDir = "gocache"
+
+	// The directory of pre-approved Go modules, laid out as a module
+	// proxy.
+	GoProxyDir = "goproxy"
+
+	// The directory holding the JSON and YAML language definitions.
+	LanguageDir = "languages"
+
+	// The directory holding plugin executables and sockets.
+	PluginDir = "plugins"
+
 	// Timeout seconds for running compiled programs.
 	RunTimeout = 3
 
+	// Timeout seconds for building programs.
+	BuildTimeout = 60
+
+	// Memory limit in megabytes for running programs.
+	MemoryLimit = 256
+
+	// Memory limit in megabytes for building programs.
+	BuildMemoryLimit = 1024
+
+	// The unprivileged user and group running the sandboxed
+	// processes, nobody and nogroup.
+	SandboxUid = 65534
+	SandboxGid = 65534
+
 	// Max length of feedback
 	MaxLength = 256
+
+	// Max length of a produced artifact
+	MaxArtifactLength = 64 * 1024
+
+	// Max number of diagnostics reported
+	MaxDiagnostics = 100
 )
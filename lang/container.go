@@ -0,0 +1,280 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	_ "github.com/opencontainers/runc/libcontainer/nsenter"
+	"github.com/opencontainers/runc/libcontainer/specconv"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	fconf     = "libcontainer.json"
+	runc_root = "/run/lotsawa/runc"
+)
+
+// Container runs the commands in runc containers, as described by
+// libcontainer.json
+type Container struct {
+	config  *configs.Config
+	factory libcontainer.Factory
+}
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runtime.GOMAXPROCS(1)
+		runtime.LockOSThread()
+		factory, _ := libcontainer.New("")
+		if err := factory.StartInitialization(); err != nil {
+			log.Fatal(err)
+		}
+		panic("--this line should have never been executed, congratulations--")
+	}
+}
+
+func NewContainer() (*Container, error) {
+	var err error
+	var c Container
+
+	err = os.MkdirAll(runc_root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Access(runc_root, 0x7)
+	if err != nil {
+		return nil, err
+	}
+
+	c.factory, err = createFactory()
+	if err != nil {
+		return nil, err
+	}
+
+	c.config, err = loadConfig(fconf)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Container) Name() string {
+	return SandboxContainer
+}
+
+// Prepare hands the workspace to the sandbox user, and makes the work
+// directory of the overlay mounted on it
+func (c *Container) Prepare(dir string) error {
+	err := giveAway(dir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir+"-work", 0775)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *Container) Cleanup(dir string) error {
+	return os.RemoveAll(dir + "-work")
+}
+
+func loadConfig(path string) (*configs.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("JSON specification file %s not found", path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var spec *specs.Spec
+	if err = json.NewDecoder(f).Decode(&spec); err != nil {
+		return nil, err
+	}
+
+	var config *configs.Config
+	config, err = specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
+		CgroupName:       "",
+		UseSystemdCgroup: false,
+		NoPivotRoot:      true,
+		NoNewKeyring:     true,
+		Spec:             spec,
+	})
+	return config, nil
+}
+
+func createFactory() (libcontainer.Factory, error) {
+	abs, err := filepath.Abs(runc_root)
+	if err != nil {
+		return nil, err
+	}
+	return libcontainer.New(abs, libcontainer.Cgroupfs, func(l *libcontainer.LinuxFactory) error {
+		l.CriuPath = "criu"
+		return nil
+	})
+}
+
+func (c *Container) run(name string,
+	args []string,
+	env []string,
+	binds []string,
+	wd string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	memory int,
+	profile string) error {
+	var err error
+	var id string
+
+	id = path.Base(wd)
+
+	// mount base rootfs with working directory
+	rootfs := c.config.Rootfs
+	lowerdir := rootfs
+	upperdir, err := filepath.Abs(wd)
+	if err != nil {
+		return err
+	}
+	workdir, err := filepath.Abs(fmt.Sprintf("%s-%s", wd, "work"))
+	if err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		lowerdir, upperdir, workdir)
+	err = syscall.Mount("overlay", upperdir, "overlay", syscall.MS_MGC_VAL,
+		opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := syscall.Unmount(upperdir, 0)
+		if err != nil {
+			return
+		}
+	}()
+
+	// set cgroup path and limits, leaving the master's alone
+	var config configs.Config
+	var cgroup configs.Cgroup
+	var resources configs.Resources
+	config = *c.config
+	cgroup = *config.Cgroups
+	cgroup.Path = fmt.Sprintf("%s/%s", cgroup.Path, id)
+	if cgroup.Resources != nil {
+		resources = *cgroup.Resources
+	}
+	if memory > 0 {
+		resources.Memory = int64(memory) << 20
+		resources.MemorySwap = resources.Memory
+	}
+	cgroup.Resources = &resources
+	config.Cgroups = &cgroup
+	if profile != "" {
+		config.Seccomp = seccompConfig(profile)
+	}
+	// no capabilities, and nothing gained from setuid programs
+	config.Capabilities = nil
+	config.NoNewPrivileges = true
+	config.Rootfs = upperdir
+	config.Mounts = config.Mounts[:len(config.Mounts):len(config.Mounts)]
+	for _, dir := range binds {
+		config.Mounts = append(config.Mounts, &configs.Mount{
+			Source:      dir,
+			Destination: dir,
+			Device:      "bind",
+			Flags:       syscall.MS_BIND | syscall.MS_REC | syscall.MS_RDONLY,
+		})
+	}
+	container, err := c.factory.Create(id, &config)
+	if err != nil {
+		return err
+	}
+	defer container.Destroy()
+
+	args = append([]string{name}, args...)
+	process := &libcontainer.Process{
+		Args:   args,
+		Env:    append([]string{"PATH=/bin:/sbin:/usr/bin:/usr/sbin"}, env...),
+		User:   fmt.Sprintf("%d:%d", SandboxUid, SandboxGid),
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+
+	err = container.Run(process)
+	if err != nil {
+		return err
+	}
+
+	_, err = process.Wait()
+	if err != nil {
+		// the cgroup counts the allocations it refused
+		stats, serr := container.Stats()
+		if serr == nil && stats.CgroupStats != nil &&
+			stats.CgroupStats.MemoryStats.Usage.Failcnt > 0 {
+			return &memoryError{int(resources.Memory >> 20)}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Exec runs the command in a container of its own, under timeout
+func (c *Container) Exec(cmd *Command) error {
+	sec := fmt.Sprintf("%d", int(cmd.Timeout.Seconds()))
+	args := append([]string{"-k", "1", sec, cmd.Name}, cmd.Args...)
+	audit := openSeccompLog()
+	defer audit.Close()
+	err := c.run("timeout",
+		args,
+		cmd.Env,
+		cmd.Binds,
+		cmd.Dir,
+		cmd.Stdin,
+		cmd.Stdout,
+		cmd.Stderr,
+		cmd.Memory,
+		cmd.Seccomp)
+
+	start := time.Now()
+	if err != nil {
+		// a runtime losing a thread to seccomp may hang until the
+		// timeout rather than die
+		if call, ok := audit.denied(cmd.Name); ok {
+			return &seccompError{call}
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			pst := ee.ProcessState
+			if st, ok := pst.Sys().(syscall.WaitStatus); ok {
+				if st.ExitStatus() == 124 {
+					err = &timeoutError{time.Now().Sub(start), ""}
+				}
+				// timeout passes on the signal killing the program
+				if st.Signaled() && st.Signal() == syscall.SIGSYS ||
+					st.ExitStatus() == 128+int(syscall.SIGSYS) {
+					err = &seccompError{}
+				}
+			}
+		}
+		return err
+	}
+
+	return nil
+}
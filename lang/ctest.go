@@ -0,0 +1,325 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// void test_name(void)
+const unitTestPtn = `(?m)^[ \t]*void[ \t]+(test_\w+)[ \t]*\([ \t]*(void)?[ \t]*\)`
+
+var unitTestRe = regexp.MustCompile(unitTestPtn)
+
+// The assertions available to the tests
+const unitHeader = `#ifndef UNIT_H
+#define UNIT_H
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+static void unit_fail(const char *file, int line, const char *msg)
+{
+	fflush(stdout);
+	fprintf(stderr, "%s:%d: %s\n", file, line, msg);
+	exit(1);
+}
+
+static void unit_fail_long(const char *file, int line, const char *expr,
+	long a, long b)
+{
+	fflush(stdout);
+	fprintf(stderr, "%s:%d: expected %s, got %ld and %ld\n",
+		file, line, expr, a, b);
+	exit(1);
+}
+
+static void unit_fail_double(const char *file, int line, const char *expr,
+	double a, double b)
+{
+	fflush(stdout);
+	fprintf(stderr, "%s:%d: expected %s, got %g and %g\n",
+		file, line, expr, a, b);
+	exit(1);
+}
+
+static void unit_fail_str(const char *file, int line, const char *expr,
+	const char *a, const char *b)
+{
+	fflush(stdout);
+	fprintf(stderr, "%s:%d: expected %s, got \"%s\" and \"%s\"\n",
+		file, line, expr, a, b);
+	exit(1);
+}
+
+#define FAIL(msg) unit_fail(__FILE__, __LINE__, (msg))
+
+#define ASSERT(cond) do { \
+	if (!(cond)) \
+		unit_fail(__FILE__, __LINE__, "assertion failed: " #cond); \
+} while (0)
+
+#define ASSERT_EQ(a, b) do { \
+	long unit_a_ = (long)(a), unit_b_ = (long)(b); \
+	if (unit_a_ != unit_b_) \
+		unit_fail_long(__FILE__, __LINE__, #a " == " #b, \
+			unit_a_, unit_b_); \
+} while (0)
+
+#define ASSERT_NE(a, b) do { \
+	long unit_a_ = (long)(a), unit_b_ = (long)(b); \
+	if (unit_a_ == unit_b_) \
+		unit_fail_long(__FILE__, __LINE__, #a " != " #b, \
+			unit_a_, unit_b_); \
+} while (0)
+
+#define ASSERT_NEAR(a, b, eps) do { \
+	double unit_a_ = (double)(a), unit_b_ = (double)(b); \
+	if (unit_a_ - unit_b_ > (eps) || unit_b_ - unit_a_ > (eps)) \
+		unit_fail_double(__FILE__, __LINE__, #a " ~ " #b, \
+			unit_a_, unit_b_); \
+} while (0)
+
+#define ASSERT_STR_EQ(a, b) do { \
+	const char *unit_a_ = (a), *unit_b_ = (b); \
+	if (strcmp(unit_a_, unit_b_) != 0) \
+		unit_fail_str(__FILE__, __LINE__, #a " == " #b, \
+			unit_a_, unit_b_); \
+} while (0)
+
+#endif
+`
+
+// The runner forks a child for each test, and prints a record for it:
+// "@@unit name outcome usec signal length" and the output of the test.
+const unitRunner = `#define _POSIX_C_SOURCE 200809L
+#undef main
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/time.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+%s
+static const struct {
+	const char *name;
+	void (*fn)(void);
+} unit_tests[] = {
+%s};
+
+#define UNIT_MAX_OUTPUT 4096
+
+int main(void)
+{
+	size_t i;
+	int failed = 0;
+
+	for (i = 0; i < sizeof(unit_tests) / sizeof(unit_tests[0]); i++) {
+		char buf[UNIT_MAX_OUTPUT], tmp[512];
+		size_t len = 0;
+		ssize_t n;
+		int fds[2], status, sig = 0;
+		struct timeval start, end;
+		long usec;
+		pid_t pid;
+		const char *outcome = "pass";
+
+		fflush(stdout);
+		if (pipe(fds) != 0) {
+			perror("pipe");
+			return 2;
+		}
+		gettimeofday(&start, NULL);
+		pid = fork();
+		if (pid < 0) {
+			perror("fork");
+			return 2;
+		}
+		if (pid == 0) {
+			close(fds[0]);
+			dup2(fds[1], 1);
+			dup2(fds[1], 2);
+			close(fds[1]);
+			alarm(%d);
+			unit_tests[i].fn();
+			exit(0);
+		}
+		close(fds[1]);
+		while ((n = read(fds[0], tmp, sizeof(tmp))) > 0) {
+			if ((size_t)n > sizeof(buf) - len)
+				n = sizeof(buf) - len;
+			memcpy(buf + len, tmp, n);
+			len += n;
+		}
+		close(fds[0]);
+		waitpid(pid, &status, 0);
+		gettimeofday(&end, NULL);
+		usec = (end.tv_sec - start.tv_sec) * 1000000L +
+			(end.tv_usec - start.tv_usec);
+
+		if (WIFSIGNALED(status))
+			sig = WTERMSIG(status);
+		if (!WIFEXITED(status) || WEXITSTATUS(status) != 0) {
+			outcome = "fail";
+			failed++;
+		}
+		printf("\n@@unit %%s %%s %%ld %%d %%lu\n", unit_tests[i].name,
+			outcome, usec, sig, (unsigned long)len);
+		fwrite(buf, 1, len, stdout);
+	}
+	return failed ? 1 : 0;
+}
+`
+
+// test links the test functions in the code against the assertions
+// and runs each of them in a process of its own
+func (c *CBase) test(caller Compiler, req *Args, prelude string) *Result {
+	var err error
+	var stdOut, stdErr bytes.Buffer
+	var result Result
+	var dir string
+	var id string
+
+	dir, id, err = createWorkspace(caller)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return &result
+	}
+
+	code := req.Code
+	err = writeFiles(dir, req.Files)
+	if err == nil {
+		err = writeSource(filepath.Join(dir, c.fsrc), code)
+	}
+	if err != nil {
+		log.Println("Failed to write source:", err)
+		result.Error = err.Error()
+		return &result
+	}
+	units := listFiles(req.Files, ".c", false)
+
+	var decls, table bytes.Buffer
+	names := unitTests(code)
+	for _, unit := range units {
+		names = append(names, unitTests(req.Files[unit])...)
+	}
+	for _, name := range names {
+		fmt.Fprintf(&decls, "void %s(void);\n", name)
+		fmt.Fprintf(&table, "\t{%q, %s},\n", name, name)
+	}
+	if len(names) == 0 {
+		result.Error = "no test_ functions found"
+		return &result
+	}
+	err = writeSource(filepath.Join(dir, "unit.h"), unitHeader)
+	if err == nil {
+		err = writeSource(filepath.Join(dir, "unit_runner.c"),
+			fmt.Sprintf(unitRunner, decls.String(), table.String(),
+				RunTimeout))
+	}
+	if err != nil {
+		log.Println("Failed to write source:", err)
+		result.Error = err.Error()
+		return &result
+	}
+
+	// the runner takes over main, the code's main is left unused
+	args := append(c.flags(req), "-I.", "-Dmain=unit_user_main",
+		"-o", "./"+c.fbin, "-xc", "-", "-xnone")
+	args = append(append(args, units...), "unit_runner.c")
+	src := prelude + "#include \"unit.h\"\n#line 1 \"" + c.fsrc + "\"\n" + code
+
+	err = c.runBuild(c.path, args, nil, nil, dir, strings.NewReader(src),
+		&stdOut, &stdErr)
+	result.Cmd = c.command(args)
+	result.C_Output = getStringBuffer(&stdOut)
+	c.diagnose(&result, &stdErr)
+	if err != nil {
+		result.Error = c.cc + ": " + err.Error()
+		return &result
+	}
+
+	stdOut.Reset()
+	stdErr.Reset()
+	timeout := time.Duration(len(names)+1) * RunTimeout * time.Second
+	err = c.runTimed("./"+c.fbin, nil, dir, nil, &stdOut, &stdErr, timeout,
+		SeccompStrict)
+	if err != nil {
+		log.Println("error run:", err)
+		result.Error = c.fbin + ": " + err.Error()
+	}
+	result.Tests = parseUnitRecords(&stdOut)
+	result.P_Error = getStringBuffer(&stdErr)
+	return &result
+}
+
+// unitTests finds the test functions in the code
+func unitTests(code string) []string {
+	var names []string
+
+	for _, m := range unitTestRe.FindAllStringSubmatch(code, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// parseUnitRecords reads the records printed by the runner
+func parseUnitRecords(r io.Reader) []TestResult {
+	var tests []TestResult
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if !strings.HasPrefix(line, "@@unit ") {
+			continue
+		}
+
+		var t TestResult
+		var usec int64
+		var sig int
+		var length int
+		_, err = fmt.Sscanf(line, "@@unit %s %s %d %d %d",
+			&t.Name, &t.Outcome, &usec, &sig, &length)
+		if err != nil {
+			break
+		}
+		output := make([]byte, length)
+		_, err = io.ReadFull(br, output)
+		if err != nil {
+			break
+		}
+
+		buf := bytes.NewBuffer(output)
+		if sig != 0 && buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		switch s := syscall.Signal(sig); s {
+		case 0:
+		case syscall.SIGALRM:
+			fmt.Fprintf(buf, "test timed out after %ds", RunTimeout)
+		default:
+			fmt.Fprintf(buf, "test killed by signal: %s", s)
+		}
+		t.Time = time.Duration(usec) * time.Microsecond
+		t.Output = getStringBuffer(buf)
+		tests = append(tests, t)
+	}
+	return tests
+}
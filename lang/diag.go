@@ -0,0 +1,244 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/scanner"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is an error, warning or note reported by a compiler
+type Diagnostic struct {
+	// Path of the file relative to the workspace
+	File string
+	// Line and column, from 1, 0 if unknown
+	Line   int
+	Column int
+	// "error", "warning" or "note"
+	Severity string
+	Message  string
+	// The compiler option controlling the diagnostic, such as
+	// "-Wunused-variable"
+	Option string
+	// What the diagnostic means and how to fix it, for the common
+	// ones
+	Explanation string
+	Fix         string
+}
+
+func (d Diagnostic) String() string {
+	var s string
+
+	s = d.File
+	if d.Line > 0 {
+		s += ":" + strconv.Itoa(d.Line)
+	}
+	if d.Column > 0 {
+		s += ":" + strconv.Itoa(d.Column)
+	}
+	s += ": " + d.Severity + ": " + d.Message
+	if d.Option != "" {
+		s += " [" + d.Option + "]"
+	}
+	return s
+}
+
+// file:line:column: severity: message
+const diagPtn = `^(.+?):(\d+):(?:(\d+):)? (?:(fatal error|error|warning|note): )?(.*)$`
+
+var diagRe = regexp.MustCompile(diagPtn)
+
+// file:(section+offset): message, the linker's without debug info:
+// prog.c:(.text+0x5): undefined reference to `f'
+const linkPtn = `^(.+?):\(\S+\): (.*)$`
+
+var linkRe = regexp.MustCompile(linkPtn)
+
+// option at the end of a gcc or clang message: [-Wunused]
+var diagOptionRe = regexp.MustCompile(` \[(-W[\w=-]+)\]$`)
+
+// textDiagnostics parses the diagnostics in the usual format of the
+// compilers, a diagnostic without severity gets the given one
+func textDiagnostics(out, severity string) []Diagnostic {
+	var diags []Diagnostic
+
+	for _, line := range strings.Split(out, "\n") {
+		if m := linkRe.FindStringSubmatch(line); m != nil {
+			diags = append(diags, Diagnostic{File: m[1],
+				Severity: "error", Message: m[2]})
+			if len(diags) == MaxDiagnostics {
+				break
+			}
+			continue
+		}
+		m := diagRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d := Diagnostic{File: m[1], Severity: m[4], Message: m[5]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		if d.Severity == "" {
+			d.Severity = severity
+		} else if d.Severity == "fatal error" {
+			d.Severity = "error"
+		}
+		if o := diagOptionRe.FindStringSubmatch(d.Message); o != nil {
+			d.Option = o[1]
+			d.Message = strings.TrimSuffix(d.Message, o[0])
+		}
+		diags = append(diags, d)
+		if len(diags) == MaxDiagnostics {
+			break
+		}
+	}
+	return diags
+}
+
+type gccLocation struct {
+	File   string
+	Line   int
+	Column int
+}
+
+type gccDiagnostic struct {
+	Kind      string
+	Message   string
+	Option    string
+	Locations []struct {
+		Caret gccLocation
+	}
+	Children []gccDiagnostic
+}
+
+// gccDiagnostics reads the diagnostics gcc prints with
+// -fdiagnostics-format=json, followed by what the other tools print.
+// The diagnostics are rendered back in the usual format in the text.
+// Anything else, such as the output of clang, is parsed as text.
+func gccDiagnostics(stderr []byte) ([]Diagnostic, string) {
+	var diags []Diagnostic
+	var raw []gccDiagnostic
+	var text bytes.Buffer
+
+	// gcc may print a note of its own before the diagnostics
+	start := 0
+	if !bytes.HasPrefix(stderr, []byte("[")) {
+		start = bytes.Index(stderr, []byte("\n[")) + 1
+	}
+	dec := json.NewDecoder(bytes.NewReader(stderr[start:]))
+	err := dec.Decode(&raw)
+	if err != nil {
+		return textDiagnostics(string(stderr), "error"), string(stderr)
+	}
+
+	var add func(g gccDiagnostic)
+	add = func(g gccDiagnostic) {
+		d := Diagnostic{
+			Severity: g.Kind,
+			Message:  g.Message,
+			Option:   g.Option,
+		}
+		if d.Severity == "fatal error" {
+			d.Severity = "error"
+		}
+		if len(g.Locations) > 0 {
+			loc := g.Locations[0].Caret
+			d.File, d.Line, d.Column = loc.File, loc.Line, loc.Column
+		}
+		fmt.Fprintln(&text, d)
+		if len(diags) < MaxDiagnostics {
+			diags = append(diags, d)
+		}
+		for _, child := range g.Children {
+			add(child)
+		}
+	}
+	for _, g := range raw {
+		add(g)
+	}
+
+	// the linker and the assembler do not speak json
+	rest := append(stderr[:start:start],
+		bytes.TrimLeft(stderr[start+int(dec.InputOffset()):], "\n")...)
+	text.Write(rest)
+	return append(diags, textDiagnostics(string(rest), "error")...), text.String()
+}
+
+// renameDiagnostics reports the diagnostics of a file under another
+// name, and shifts their lines with the given mapping, if any
+func renameDiagnostics(diags []Diagnostic, from, to string, lines []int) {
+	for i := range diags {
+		if diags[i].File != from {
+			continue
+		}
+		diags[i].File = to
+		if lines != nil && diags[i].Line > 0 && diags[i].Line <= len(lines) {
+			diags[i].Line = lines[diags[i].Line-1]
+		}
+	}
+}
+
+// mapLines finds the line of the original source each line of the
+// processed one comes from, a line added by the processing maps to
+// the original line before it, or to 0.
+func mapLines(orig, processed string) []int {
+	src := strings.Split(orig, "\n")
+	out := strings.Split(processed, "\n")
+	lines := make([]int, len(out))
+
+	// gofmt changes the spacing of the lines
+	squeeze := func(s string) string {
+		return strings.Join(strings.Fields(s), "")
+	}
+	j := 0
+	for i, line := range out {
+		line = squeeze(line)
+		for k := j; k < len(src) && line != ""; k++ {
+			if squeeze(src[k]) == line {
+				j = k + 1
+				break
+			}
+		}
+		lines[i] = j
+	}
+	return lines
+}
+
+// scanDiagnostics reports the syntax errors of a Go source as the
+// diagnostics of file, the source starts offset lines before the file
+func scanDiagnostics(err error, file string, offset int) []Diagnostic {
+	var diags []Diagnostic
+
+	el, ok := err.(scanner.ErrorList)
+	if !ok {
+		return nil
+	}
+	for _, e := range el {
+		diags = append(diags, Diagnostic{
+			File:     file,
+			Line:     e.Pos.Line - offset,
+			Column:   e.Pos.Column,
+			Severity: "error",
+			Message:  e.Msg,
+		})
+		if len(diags) == MaxDiagnostics {
+			break
+		}
+	}
+	return diags
+}
+
+// goDiagnostics parses the diagnostics of the go command, the paths it
+// reports are relative to the workspace
+func goDiagnostics(stderr string) []Diagnostic {
+	diags := textDiagnostics(stderr, "error")
+	for i := range diags {
+		diags[i].File = strings.TrimPrefix(diags[i].File, "./")
+	}
+	return diags
+}
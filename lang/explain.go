@@ -0,0 +1,104 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"regexp"
+	"strings"
+)
+
+// explainRule explains the diagnostics whose message matches, the
+// explanation and the fix may refer to the submatches as ${1}.
+type explainRule struct {
+	message     *regexp.Regexp
+	explanation string
+	fix         string
+}
+
+func rule(message, explanation, fix string) explainRule {
+	return explainRule{regexp.MustCompile(message), explanation, fix}
+}
+
+// The common errors of newcomers. gcc and clang quote the names in
+// their messages, go does not.
+var explainRules = []explainRule{
+	// C
+	rule(`implicit declaration of function '(\w+)'`,
+		"The function ${1} is called before it is declared, so the "+
+			"compiler guesses how to call it, and usually guesses wrong.",
+		"Include the header declaring ${1}, or declare it before "+
+			"calling it."),
+	rule(`control reaches end of non-void function|non-void function does not return a value`,
+		"The function can end without returning a value, the caller "+
+			"then gets garbage.",
+		"Return a value on every path through the function."),
+	rule(`incompatible pointer type`,
+		"A pointer to one type is used where a pointer to another type "+
+			"is expected, the memory would be read as the wrong type.",
+		"Check the types of the pointers, an & or * too many or too "+
+			"few is the usual cause."),
+	rule(`makes (integer from pointer|pointer from integer) without a cast`,
+		"An integer and a pointer are mixed up, for example a string "+
+			"is stored in an int or a char is passed as a string.",
+		"Use a value of the expected type, such as 'c' rather than "+
+			"\"c\", or the right variable."),
+	rule(`'(\w+)' undeclared|use of undeclared identifier '(\w+)'`,
+		"The name ${1}${2} is used but never declared here.",
+		"Check its spelling, declare it before using it, or include "+
+			"the header that declares it."),
+	rule(`expected '(.+?)' before`,
+		"The compiler expected ${1} and found something else, often "+
+			"because it is missing at the end of the line before.",
+		"Add the missing ${1}."),
+	rule(`format '%(\w+)' expects argument of type '(.+?)', but argument (\d+) has type '(.+?)'`,
+		"The conversion %${1} prints a ${2}, but argument ${3} is a ${4}.",
+		"Use the conversion matching ${4}, or cast the argument to ${2}."),
+	rule(`undefined reference to [`+"`"+`'](\w+)'`,
+		"The program calls ${1} but the linker can not find its "+
+			"definition.",
+		"Define ${1}, or link the library providing it."),
+
+	// Go
+	rule(`"(.+)" imported and not used`,
+		"Go refuses to compile files importing packages they do not use.",
+		"Remove the import of ${1}, or import it as _ while the code is "+
+			"unfinished."),
+	rule(`declared and not used: (\w+)|(\w+) declared (and|but) not used`,
+		"Go refuses to compile functions with variables they never use.",
+		"Use ${1}${2}, remove it, or assign it to _."),
+	rule(`^missing return`,
+		"The function can end without returning a value.",
+		"Return a value on every path through the function."),
+	rule(`^undefined: (\S+)`,
+		"The name ${1} is not declared, or its package is not imported.",
+		"Check its spelling and capitalization, only names starting "+
+			"with a capital letter are exported."),
+
+	// Bash
+	rule("syntax error near unexpected token `(.+)'",
+		"The shell found ${1} where the command was not finished, "+
+			"usually a missing then, do, fi, done or closing quote.",
+		"Check the lines before for an unbalanced if, loop or quote."),
+}
+
+// Explain attaches a plain-language explanation and a suggested fix to
+// the diagnostics matching a rule.
+func Explain(diags []Diagnostic) {
+	for i := range diags {
+		d := &diags[i]
+		// gcc quotes with ‘’ in UTF-8 locales
+		msg := quotes.Replace(d.Message)
+		for _, r := range explainRules {
+			m := r.message.FindStringSubmatchIndex(msg)
+			if m == nil {
+				continue
+			}
+			d.Explanation = string(r.message.ExpandString(nil,
+				r.explanation, msg, m))
+			d.Fix = string(r.message.ExpandString(nil, r.fix, msg, m))
+			break
+		}
+	}
+}
+
+var quotes = strings.NewReplacer("‘", "'", "’", "'")
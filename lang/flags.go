@@ -0,0 +1,90 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// FlagPolicy decides which compiler flags users may pass. A flag is
+// accepted when it matches one of the Allow patterns and none of the
+// Deny patterns. The patterns are regular expressions matched against
+// the whole flag.
+type FlagPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// DefaultFlagPolicy lets users pick the optimization level, defines,
+// warnings and sanitizers, but nothing that reaches outside the
+// workspace or loads code into the compiler.
+var DefaultFlagPolicy = FlagPolicy{
+	Allow: []string{
+		"-O[0-3sg]?",
+		"-Ofast",
+		"-D\\w+(=.*)?",
+		"-W.*",
+		"-f(no-)?sanitize=[a-z,-]+",
+		"-f(no-)?sanitize-recover(=[a-z,-]+)?",
+	},
+	Deny: []string{
+		// -fsanitize-ignorelist= and the like read files of the host
+		".*list=.*",
+		"-o.*",
+		"-B.*",
+		"-?-specs.*",
+		"@.*",
+		"-fplugin.*",
+		// -Wl, -Wa and -Wp pass anything to the tools behind gcc
+		"-W[lap],.*",
+	},
+}
+
+// FlagTaker is implemented by the compilers passing Args.Flags to the
+// compiler, the flags are refused for the other languages rather than
+// ignored.
+type FlagTaker interface {
+	TakesFlags() bool
+}
+
+// Check returns an error naming the first flag that is not accepted.
+func (p *FlagPolicy) Check(flags []string) error {
+	allow, err := compileFlagPatterns(p.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := compileFlagPatterns(p.Deny)
+	if err != nil {
+		return err
+	}
+
+	for _, flag := range flags {
+		if !matchFlag(allow, flag) || matchFlag(deny, flag) {
+			return fmt.Errorf("flag %s is not allowed", flag)
+		}
+	}
+	return nil
+}
+
+func compileFlagPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+
+	for _, ptn := range patterns {
+		re, err := regexp.Compile("^(" + ptn + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchFlag(res []*regexp.Regexp, flag string) bool {
+	for _, re := range res {
+		if re.MatchString(flag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Definition describes a language declaratively, it is loaded from
+// a JSON or YAML file under LanguageDir. Commands are given as argument
+// lists, $SRC expands to the source file name and $MEM to MemoryLimit.
+//
+//	name: Lua
+//	aliases: [lua]
+//	source: prog.lua
+//	run: [lua, $SRC]
+//	version: [lua, -v]
+type Definition struct {
+	// Name of the compiler
+	Name string `json:"name" yaml:"name"`
+	// Other names the language is known by
+	Aliases []string `json:"aliases" yaml:"aliases"`
+	// The file the code is written to
+	Source string `json:"source" yaml:"source"`
+	// Code placed before the user's code
+	Prelude string `json:"prelude" yaml:"prelude"`
+	// Command to compile the source, optional
+	Compile []string `json:"compile" yaml:"compile"`
+	// Command to run the program
+	Run []string `json:"run" yaml:"run"`
+	// Pattern the code must match to be run, optional
+	Main string `json:"main" yaml:"main"`
+	// Command printing the version of the language
+	Version []string `json:"version" yaml:"version"`
+	// Seccomp profile of the programs, "strict" or "runtime", the
+	// default
+	Seccomp string `json:"seccomp" yaml:"seccomp"`
+}
+
+// Generic is a compiler driven by a Definition
+type Generic struct {
+	sandboxed
+	def  Definition
+	main *regexp.Regexp
+}
+
+// LoadDefinitions reads all the *.json, *.yaml and *.yml language
+// definitions in dir, skipping the invalid ones.
+func LoadDefinitions(dir string) ([]*Generic, error) {
+	var compilers []*Generic
+	var files []string
+
+	for _, ext := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		g, err := loadDefinition(file)
+		if err != nil {
+			log.Printf("skipping definition %s: %s", file, err)
+			continue
+		}
+		compilers = append(compilers, g)
+	}
+	return compilers, nil
+}
+
+func loadDefinition(file string) (*Generic, error) {
+	var g Generic
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(file) == ".json" {
+		err = json.Unmarshal(data, &g.def)
+	} else {
+		err = yaml.Unmarshal(data, &g.def)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.def.Name == "" {
+		return nil, errors.New("name is missing")
+	}
+	if g.def.Source == "" || filepath.Base(g.def.Source) != g.def.Source {
+		return nil, errors.New("source must be a plain file name")
+	}
+	if len(g.def.Run) == 0 {
+		return nil, errors.New("run command is missing")
+	}
+	if g.def.Seccomp == "" {
+		g.def.Seccomp = SeccompRuntime
+	}
+	if !ValidSeccomp(g.def.Seccomp) {
+		return nil, errors.New("unknown seccomp profile " + g.def.Seccomp)
+	}
+	if g.def.Main != "" {
+		g.main, err = regexp.Compile(g.def.Main)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &g, nil
+}
+
+func (g *Generic) Name() string {
+	return g.def.Name
+}
+
+// Aliases returns the other names of the language.
+func (g *Generic) Aliases() []string {
+	return g.def.Aliases
+}
+
+func (g *Generic) Version() string {
+	var stdout bytes.Buffer
+
+	if len(g.def.Version) == 0 {
+		return "Unknown"
+	}
+	cmd := g.expand(g.def.Version)
+	err := runLocal(cmd[0], cmd[1:], ".", nil, &stdout, &stdout)
+	if err != nil {
+		return "Unknown"
+	}
+	return stdout.String()
+}
+
+func (g *Generic) Init() error {
+	if len(g.def.Compile) > 0 {
+		if _, err := exec.LookPath(g.def.Compile[0]); err != nil {
+			return err
+		}
+	}
+	if _, err := exec.LookPath(g.def.Run[0]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (g *Generic) Compile(req *Args) *Result {
+	prog, result := g.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, prog.Name+": ", result)
+}
+
+// Build runs the compile command of the definition if it has one, the
+// program is its run command
+func (g *Generic) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
+	var stdout, stderr bytes.Buffer
+	var cmd []string
+	var dir string
+	var id string
+
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(g, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(g, g.def.Source, g.def.Prelude+code,
+		req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	if len(g.def.Compile) > 0 {
+		cmd = g.expand(g.def.Compile)
+		err = g.runBuild(cmd[0], cmd[1:], nil, nil, dir, nil, &stdout,
+			&stderr)
+		result.Cmd = strings.Join(cmd, " ")
+		result.C_Output, result.C_Error =
+			getStringBuffer(&stdout), getStringBuffer(&stderr)
+		if err != nil {
+			result.Error = cmd[0] + ": " + err.Error()
+			return nil, &result
+		}
+	}
+	if g.main != nil && !g.main.MatchString(code) {
+		return nil, &result
+	}
+
+	cmd = g.expand(g.def.Run)
+	if result.Cmd == "" {
+		result.Cmd = strings.Join(cmd, " ")
+	}
+	return &Program{sandboxed: g.sandboxed,
+		Dir: dir, Id: id, Name: cmd[0], Args: cmd[1:],
+		Seccomp: g.def.Seccomp}, &result
+}
+
+// expand substitutes the variables in a command template
+func (g *Generic) expand(tmpl []string) []string {
+	var cmd []string
+
+	for _, arg := range tmpl {
+		cmd = append(cmd, os.Expand(arg, func(v string) string {
+			switch v {
+			case "SRC":
+				return g.def.Source
+			case "MEM":
+				return fmt.Sprintf("%d", MemoryLimit)
+			}
+			return ""
+		}))
+	}
+	return cmd
+}
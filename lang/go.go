@@ -5,22 +5,39 @@ package lang
 import (
 	"bytes"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/scanner"
 	"go/token"
+	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/tools/imports"
 )
 
 type Go struct {
-	path  string
-	fsrc  string
-	fprog string
-	opt   *imports.Options
+	sandboxed
+	path    string
+	version string
+	fsrc    string
+	fprog   string
+	ftest   string
+	fmod    string
+	fbin    string
+	module  string
+	opt     *imports.Options
+	env     []string
+	binds   []string
+	warm    sync.Once
+	warmed  chan struct{}
+	mods    []goModule
+	pkgs    map[string]string
 }
 
 func (g *Go) Name() string {
@@ -42,31 +59,212 @@ func (g *Go) Init() error {
 		return err
 	}
 	g.path = path
+	g.version = g.Version()
 	g.fsrc = "source.go"
 	g.fprog = "prog.go"
+	g.ftest = "prog_test.go"
+	g.fmod = "go.mod"
+	g.fbin = "prog"
+	g.module = "prog"
+	// the comments hold the expected output of the examples
 	g.opt = &imports.Options{
-		Fragment: true,
+		Fragment:  true,
+		Comments:  true,
+		TabIndent: true,
+		TabWidth:  8,
+	}
+	g.warmed = make(chan struct{})
+	return g.initEnv()
+}
+
+// SetSandbox gives the compiler its sandbox. The sandbox can not fill
+// the build cache, it is warmed in the background meanwhile.
+func (g *Go) SetSandbox(sb Sandbox) {
+	g.sandboxed.SetSandbox(sb)
+	// nothing to warm if go is missing
+	if sb.Name() == SandboxHost || g.warmed == nil {
+		return
+	}
+	g.warm.Do(func() {
+		go g.warmCache()
+	})
+}
+
+// initEnv sets up the environment of the go command: the builds share
+// the build and module caches, and modules only come from the local
+// proxy.
+func (g *Go) initEnv() error {
+	cache, err := filepath.Abs(GoCacheDir)
+	if err != nil {
+		return err
+	}
+	build, mod := filepath.Join(cache, "build"), filepath.Join(cache, "mod")
+	for _, dir := range []string{build, mod} {
+		err = os.MkdirAll(dir, 0775)
+		if err != nil {
+			return err
+		}
+	}
+	// the sandbox user fills the caches
+	err = giveAway(cache)
+	if err != nil {
+		return err
+	}
+	g.binds = []string{cache}
+
+	proxy, err := filepath.Abs(GoProxyDir)
+	if err != nil {
+		return err
+	}
+	goproxy := "off"
+	if fi, err := os.Stat(proxy); err == nil && fi.IsDir() {
+		goproxy = "file://" + proxy
+		g.binds = append(g.binds, proxy)
+		g.mods, g.pkgs, err = loadGoModules(proxy)
+		if err != nil {
+			return err
+		}
+	}
+
+	g.env = []string{
+		"GOCACHE=" + build,
+		"GOMODCACHE=" + mod,
+		"GOPATH=" + cache,
+		"GOPROXY=" + goproxy,
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+		"GOFLAGS=-mod=mod",
+		// the module index is written to the build cache, which the
+		// sandbox can not
+		"GODEBUG=goindex=0",
 	}
 	return nil
 }
 
-func (g *Go) Compile(code string) *Result {
+// The packages most programs and tests build on, they are warmed first
+var goWarmPackages = []string{"fmt", "testing", "runtime/coverage"}
+
+// The rest of the standard library is built once by the process
+var goWarmStd sync.Once
+
+// warmCache downloads the approved modules into the module cache, and
+// builds the standard library into the build cache, which the sandbox
+// can only read. The builds stop waiting once the modules and the
+// packages most of them need are in.
+func (g *Go) warmCache() {
+	start := time.Now()
+	err := g.warmRun("downloading go modules", g.modArgs())
+	if err == nil {
+		err = g.warmRun("warming go build cache",
+			append([]string{"build"}, goWarmPackages...))
+	}
+	close(g.warmed)
+	if err != nil {
+		return
+	}
+	goWarmStd.Do(func() {
+		err = g.warmRun("warming go build cache", []string{"build", "std"})
+		if err == nil {
+			log.Printf("warmed go build cache in %s", time.Since(start))
+		}
+	})
+}
+
+// modArgs returns the command downloading the approved modules, nil if
+// there are none
+func (g *Go) modArgs() []string {
+	if len(g.mods) == 0 {
+		return nil
+	}
+	args := []string{"mod", "download"}
+	for _, m := range g.mods {
+		args = append(args, m.Path+"@"+m.Version)
+	}
+	return args
+}
+
+// warmRun runs a go command filling the shared caches
+func (g *Go) warmRun(what string, args []string) error {
+	var stderr bytes.Buffer
+
+	if len(args) == 0 {
+		return nil
+	}
+	err := runLocalTimed(g.path, args, g.env, GoCacheDir, nil, nil,
+		&stderr, 10*BuildTimeout*time.Second, 0)
+	if err != nil {
+		log.Printf("%s: %s: %s", what, err, stderr.String())
+	}
+	return err
+}
+
+// runGo runs the go command with the shared caches. The builds in a
+// sandbox wait for the caches to be warm for as long as a build may
+// take, and then fill caches of their own in the workspace.
+func (g *Go) runGo(args []string, dir string, stdout,
+	stderr io.Writer) error {
+	env := g.env
+	if g.Sandbox().Name() != SandboxHost {
+		select {
+		case <-g.warmed:
+		case <-time.After(BuildTimeout * time.Second):
+			cache, err := filepath.Abs(filepath.Join(dir, ".gocache"))
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(cache)
+			env = make([]string, 0, len(g.env))
+			for _, kv := range g.env {
+				switch {
+				case strings.HasPrefix(kv, "GOCACHE="):
+					kv = "GOCACHE=" + filepath.Join(cache, "build")
+				case strings.HasPrefix(kv, "GOMODCACHE="):
+					kv = "GOMODCACHE=" + filepath.Join(cache, "mod")
+				}
+				env = append(env, kv)
+			}
+		}
+	}
+	return g.runBuild(g.path, args, env, g.binds, dir, nil, stdout, stderr)
+}
+
+func (g *Go) Compile(req *Args) *Result {
+	if req.Mode == ModeTest {
+		return g.test(req)
+	}
+	prog, result := g.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, "", result)
+}
+
+func (g *Go) Build(req *Args) (*Program, *Result) {
 	var result Result
 	var err error
-	var stdout, stderr bytes.Buffer
-	var args []string
 	var dir string
 	var id string
 	var filetorun string
 
-	dir, id, err = setupWorkspace(g, g.fsrc, code)
+	if req.Mode != ModeRun && req.Mode != ModeAssembly {
+		return nil, unsupportedMode(g, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(g, g.fsrc, code, req.Files)
 	result.Id = id
 	if err != nil {
-		return &Result{Error: err.Error()}
+		return nil, &Result{Error: err.Error()}
 	}
 	filetorun = g.fsrc
 
+	sources := listFiles(req.Files, ".go", true)
+	if code == "" {
+		return g.build(req, dir, id, sources, nil, &result)
+	}
+
 	var source string = code
+	var offset int
 	var fset *token.FileSet
 	fset = token.NewFileSet()
 	_, err = parser.ParseFile(fset, "stdin", code, 0)
@@ -75,47 +273,164 @@ func (g *Go) Compile(code string) *Result {
 			if !strings.HasPrefix(el[0].Msg,
 				"expected 'package', found 'func'") {
 				source = fmt.Sprintf("func main() {\n%s\n}", code)
+				offset = 1
 			}
 		} else {
 			result.Error = err.Error()
-			return &result
+			return nil, &result
 		}
 	}
 
 	processed, err := imports.Process("stdin", []byte(source), g.opt)
 	if err != nil {
-		fmt.Println(source)
-		fmt.Println(err)
-		el := err.(scanner.ErrorList)
-		for i := 0; i < el.Len(); i++ {
-			fmt.Println(el[i])
-		}
+		result.Diagnostics = scanDiagnostics(err, g.fsrc, offset)
 		result.Error = err.Error()
-		return &result
+		return nil, &result
 	}
+	processed = g.addImports(keepImports([]byte(source), processed))
+	lines := mapLines(code, string(processed))
 
 	err = writeSource(fmt.Sprintf("%s/%s", dir, g.fprog),
 		string(processed))
 	if err != nil {
 		result.Error = err.Error()
-		return &result
+		return nil, &result
 	}
 	filetorun = g.fprog
 
-	args = []string{"run", filetorun}
-	err = runTimed(g.path,
-		args,
-		dir,
-		nil,
-		&stdout,
-		&stderr,
-		RunTimeout*time.Second)
+	return g.build(req, dir, id, append([]string{filetorun}, sources...),
+		lines, &result)
+}
+
+// build compiles the files into the program, or prints their assembly.
+// lines maps the lines of the processed code to the original ones.
+func (g *Go) build(req *Args, dir, id string, files []string,
+	lines []int, result *Result) (*Program, *Result) {
+	var err error
+	var stdout, stderr bytes.Buffer
+	var args []string
+
+	// the program is built as a module requiring the approved modules
+	// it imports
+	var mod string
+	if _, ok := req.Files[g.fmod]; !ok {
+		mod = g.goMod(dir, files)
+		err = writeSource(filepath.Join(dir, g.fmod), mod)
+		if err != nil {
+			result.Error = err.Error()
+			return nil, result
+		}
+	}
+
+	if req.Mode == ModeAssembly {
+		return nil, g.assemble(req, dir, files, lines, result)
+	}
+
+	args = append([]string{"build", "-o", g.fbin}, files...)
+	result.Cmd = strings.Join(append([]string{"go"}, args...), " ")
+
+	key := cacheKey(g, g.version, args, mod+req.Code, req.Files)
+	binFile := filepath.Join(dir, g.fbin)
+	if cacheLoad(key, binFile, result) {
+		result.Cached = true
+		return &Program{sandboxed: g.sandboxed,
+			Dir: dir, Id: id, Name: "./" + g.fbin,
+			Seccomp: SeccompRuntime}, result
+	}
+
+	err = g.runGo(args, dir, &stdout, &stderr)
+	result.C_Output = getStringBuffer(&stdout)
+	g.diagnose(result, &stderr, lines)
 	if err != nil {
 		log.Println(err)
 		result.Error = err.Error()
+		return nil, result
+	}
+	cacheStore(key, binFile, result)
+	return &Program{sandboxed: g.sandboxed,
+		Dir: dir, Id: id, Name: "./" + g.fbin,
+		Seccomp: SeccompRuntime}, result
+}
+
+// diagnose parses the diagnostics of the go command into the result,
+// the processed code is reported as the original one
+func (g *Go) diagnose(result *Result, stderr *bytes.Buffer, lines []int) {
+	result.Diagnostics = goDiagnostics(stderr.String())
+	renameDiagnostics(result.Diagnostics, g.fprog, g.fsrc, lines)
+	result.C_Error = getStringBuffer(stderr)
+}
+
+// assemble builds the program with the compiler printing the assembly
+func (g *Go) assemble(req *Args, dir string, files []string,
+	lines []int, result *Result) *Result {
+	var err error
+	var stdout, stderr bytes.Buffer
+	var args []string
+
+	// -O0 turns off optimizations and inlining
+	gcflags := "-gcflags=-S"
+	if req.Opt == "-O0" {
+		gcflags = "-gcflags=-S -N -l"
 	}
+	args = append([]string{"build", gcflags, "-o", os.DevNull}, files...)
+	err = g.runGo(args, dir, &stdout, &stderr)
 	result.Cmd = strings.Join(append([]string{"go"}, args...), " ")
-	result.P_Output = getStringBuffer(&stdout)
-	result.P_Error = getStringBuffer(&stderr)
-	return &result
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+		g.diagnose(result, &stderr, lines)
+		return result
+	}
+	// the compiler prints the assembly on stderr
+	result.C_Output = getStringBuffer(&stdout)
+	result.Artifact = getArtifactBuffer(&stderr)
+	return result
+}
+
+// keepImports imports again the packages the source imports and which
+// goimports removed for being unused, the compiler reports them instead
+func keepImports(src, processed []byte) []byte {
+	orig, err := parser.ParseFile(token.NewFileSet(), "", src,
+		parser.ImportsOnly)
+	if err != nil {
+		return processed
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", processed, parser.ImportsOnly)
+	if err != nil {
+		return processed
+	}
+	kept := make(map[string]bool)
+	for _, spec := range file.Imports {
+		kept[importKey(spec)] = true
+	}
+
+	var removed []string
+	for _, spec := range orig.Imports {
+		if key := importKey(spec); !kept[key] {
+			removed = append(removed, key)
+			kept[key] = true
+		}
+	}
+	if len(removed) == 0 {
+		return processed
+	}
+
+	var buf bytes.Buffer
+	end := fset.Position(file.Name.End()).Offset
+	buf.Write(processed[:end])
+	buf.WriteString("\n")
+	for _, key := range removed {
+		fmt.Fprintf(&buf, "\nimport %s", key)
+	}
+	buf.Write(processed[end:])
+	return buf.Bytes()
+}
+
+// importKey is the import spec as written: the path, named or not
+func importKey(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name + " " + spec.Path.Value
+	}
+	return spec.Path.Value
 }
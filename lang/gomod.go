@@ -0,0 +1,214 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// go1.21.3 -> 1.21
+var goVersionRe = regexp.MustCompile(`go(\d+\.\d+)`)
+
+// goModule is a module approved for the programs, served by the local
+// module proxy
+type goModule struct {
+	Path    string
+	Version string
+}
+
+// loadGoModules finds the modules in the local proxy and the packages
+// they provide, keyed by package name. A name provided by several
+// packages is left out, it can not be imported by guessing.
+func loadGoModules(proxy string) ([]goModule, map[string]string, error) {
+	var mods []goModule
+	pkgs := make(map[string]string)
+	ambiguous := make(map[string]bool)
+
+	err := filepath.Walk(proxy, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || fi.Name() != "list" ||
+			filepath.Base(filepath.Dir(p)) != "@v" {
+			return err
+		}
+		rel, err := filepath.Rel(proxy, filepath.Dir(filepath.Dir(p)))
+		if err != nil {
+			return err
+		}
+		mod := goModule{Path: filepath.ToSlash(rel)}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		// the list is in release order, the last one is approved
+		versions := strings.Fields(string(data))
+		if len(versions) == 0 {
+			return nil
+		}
+		mod.Version = versions[len(versions)-1]
+		mods = append(mods, mod)
+
+		names, err := modulePackages(filepath.Dir(p), mod)
+		if err != nil {
+			log.Printf("could not read module %s: %s", mod.Path, err)
+			return nil
+		}
+		for name, pkg := range names {
+			if other, ok := pkgs[name]; ok && other != pkg {
+				ambiguous[name] = true
+			}
+			pkgs[name] = pkg
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for name := range ambiguous {
+		delete(pkgs, name)
+	}
+	return mods, pkgs, nil
+}
+
+// modulePackages lists the packages in the zip of the module, keyed
+// by package name
+func modulePackages(dir string, mod goModule) (map[string]string, error) {
+	r, err := zip.OpenReader(filepath.Join(dir, mod.Version+".zip"))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	prefix := mod.Path + "@" + mod.Version + "/"
+	pkgs := make(map[string]string)
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == f.Name || !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") ||
+			strings.Contains(name, "internal/") ||
+			strings.Contains(name, "testdata/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), name, rc,
+			parser.PackageClauseOnly)
+		rc.Close()
+		if err != nil || file.Name.Name == "main" {
+			continue
+		}
+		pkgs[file.Name.Name] = path.Join(mod.Path, path.Dir(name))
+	}
+	return pkgs, nil
+}
+
+// addImports imports the approved packages the source uses without
+// importing them
+func (g *Go) addImports(src []byte) []byte {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return src
+	}
+	imported := make(map[string]bool)
+	for _, spec := range file.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		if spec.Name != nil {
+			imported[spec.Name.Name] = true
+		} else {
+			imported[path.Base(p)] = true
+		}
+	}
+
+	var paths []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		// the parser leaves the package names unresolved
+		x, ok := sel.X.(*ast.Ident)
+		if !ok || x.Obj != nil || imported[x.Name] {
+			return true
+		}
+		if p, ok := g.pkgs[x.Name]; ok {
+			paths = append(paths, p)
+			imported[x.Name] = true
+		}
+		return true
+	})
+	if len(paths) == 0 {
+		return src
+	}
+
+	var buf bytes.Buffer
+	end := fset.Position(file.Name.End()).Offset
+	buf.Write(src[:end])
+	buf.WriteString("\n")
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "\nimport %q", p)
+	}
+	buf.Write(src[end:])
+	return buf.Bytes()
+}
+
+// goMod generates the go.mod of the program in dir, requiring the
+// approved modules its files import
+func (g *Go) goMod(dir string, files []string) string {
+	required := make(map[string]bool)
+	for _, name := range files {
+		file, err := parser.ParseFile(token.NewFileSet(),
+			filepath.Join(dir, name), nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range file.Imports {
+			p, _ := strconv.Unquote(spec.Path.Value)
+			if mod := g.moduleOf(p); mod != nil {
+				required[mod.Path+" "+mod.Version] = true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "module %s\n", g.module)
+	if m := goVersionRe.FindStringSubmatch(g.version); m != nil {
+		fmt.Fprintf(&buf, "\ngo %s\n", m[1])
+	}
+	if len(required) > 0 {
+		reqs := make([]string, 0, len(required))
+		for r := range required {
+			reqs = append(reqs, r)
+		}
+		sort.Strings(reqs)
+		fmt.Fprintf(&buf, "\nrequire (\n\t%s\n)\n",
+			strings.Join(reqs, "\n\t"))
+	}
+	return buf.String()
+}
+
+// moduleOf finds the approved module providing the package p
+func (g *Go) moduleOf(p string) *goModule {
+	var found *goModule
+	for i, mod := range g.mods {
+		if (p == mod.Path || strings.HasPrefix(p, mod.Path+"/")) &&
+			(found == nil || len(mod.Path) > len(found.Path)) {
+			found = &g.mods[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/imports"
+)
+
+// The time each benchmark runs for
+const goBenchTime = time.Second
+
+// testEvent is an event printed by test2json
+type testEvent struct {
+	Action  string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// test runs the tests, benchmarks and examples in the code
+func (g *Go) test(req *Args) *Result {
+	var result Result
+	var err error
+	var stdout, stderr bytes.Buffer
+	var dir string
+	var id string
+
+	// go test builds every file in the package, the processed source
+	// replaces the code
+	code := req.Code
+	dir, id, err = setupWorkspace(g, g.ftest, code, req.Files)
+	result.Id = id
+	if err != nil {
+		return &Result{Error: err.Error()}
+	}
+
+	source := code
+	offset := 0
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, "stdin", code, parser.PackageClauseOnly)
+	if err != nil {
+		// the tests of a snippet go in a package of their own
+		source = "package " + g.module + "\n\n" + code
+		offset = 2
+	}
+	processed, err := imports.Process("stdin", []byte(source), g.opt)
+	if err != nil {
+		result.Diagnostics = scanDiagnostics(err, g.ftest, offset)
+		result.Error = err.Error()
+		return &result
+	}
+	processed = g.addImports(keepImports([]byte(source), processed))
+	lines := mapLines(code, string(processed))
+	if !hasTests(processed) {
+		result.Error = "no tests, benchmarks or examples found"
+		return &result
+	}
+
+	err = writeSource(filepath.Join(dir, g.ftest), string(processed))
+	if err != nil {
+		result.Error = err.Error()
+		return &result
+	}
+	files := append([]string{g.ftest}, listFiles(req.Files, ".go", true)...)
+	if _, ok := req.Files[g.fmod]; !ok {
+		err = writeSource(filepath.Join(dir, g.fmod), g.goMod(dir, files))
+		if err != nil {
+			result.Error = err.Error()
+			return &result
+		}
+	}
+
+	// the test binary is built with the limits of the builds, and run
+	// with the limits of the programs
+	testbin := g.fbin + ".test"
+	args := []string{"test", "-c", "-o", testbin}
+	if req.Race {
+		args = append(args, "-race")
+	}
+	if req.Cover {
+		args = append(args, "-cover")
+	}
+	args = append(args, ".")
+
+	err = g.runGo(args, dir, &stdout, &stderr)
+	result.Cmd = strings.Join(append([]string{"go"}, args...), " ")
+	result.C_Output = getStringBuffer(&stdout)
+	result.Diagnostics = goDiagnostics(stderr.String())
+	renameDiagnostics(result.Diagnostics, g.ftest, g.ftest, lines)
+	result.C_Error = getStringBuffer(&stderr)
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+		return &result
+	}
+
+	var output bytes.Buffer
+	targs := []string{"-test.v=test2json", "-test.count=1"}
+	timeout := RunTimeout * time.Second
+	if req.Bench != "" {
+		targs = append(targs, "-test.bench="+req.Bench,
+			"-test.benchtime="+goBenchTime.String())
+		// a benchmark takes about twice its time to find its b.N
+		srcs := [][]byte{processed}
+		for _, name := range listFiles(req.Files, ".go", true) {
+			if strings.HasSuffix(name, "_test.go") {
+				srcs = append(srcs, []byte(req.Files[name]))
+			}
+		}
+		for _, src := range srcs {
+			timeout += time.Duration(countBenchmarks(src)) * 2 * goBenchTime
+		}
+	}
+	err = g.runTimed("./"+testbin, targs, dir, nil, &output, &output,
+		timeout, SeccompRuntime)
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+	}
+	result.Cmd += "; " + strings.Join(append([]string{"./" + testbin},
+		targs...), " ")
+
+	// test2json turns what the binary printed into the events of the
+	// tests, it only reads the output
+	var events bytes.Buffer
+	stderr.Reset()
+	err = runLocalTimed(g.path, []string{"tool", "test2json", "-p", g.module},
+		g.env, dir, &output, &events, &stderr, BuildTimeout*time.Second, 0)
+	if err != nil {
+		log.Println("test2json:", err, stderr.String())
+		result.P_Output = getStringBuffer(&output)
+		return &result
+	}
+	output.Reset()
+	result.Tests = parseTestEvents(&events, &output)
+	result.P_Output = getStringBuffer(&output)
+	return &result
+}
+
+// hasTests reports whether the source has a test, benchmark or example
+func hasTests(src []byte) bool {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		// let the compiler report the error
+		return true
+	}
+	for name, obj := range file.Scope.Objects {
+		if obj.Kind == ast.Fun &&
+			(isTestName(name, "Test") || isTestName(name, "Benchmark") ||
+				isTestName(name, "Example")) {
+			return true
+		}
+	}
+	return false
+}
+
+// countBenchmarks counts the benchmarks in the source
+func countBenchmarks(src []byte) int {
+	var n int
+
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return 0
+	}
+	for name, obj := range file.Scope.Objects {
+		if obj.Kind == ast.Fun && isTestName(name, "Benchmark") {
+			n++
+		}
+	}
+	return n
+}
+
+// isTestName is what go test thinks: TestXxx, but not Testxxx
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// parseTestEvents reads the events of test2json into the results of the
+// tests, in the order they started. The output of the package outside
+// of the tests, such as the coverage, goes to out.
+func parseTestEvents(r io.Reader, out *bytes.Buffer) []TestResult {
+	var tests []TestResult
+	var index = make(map[string]int)
+	var outputs []*bytes.Buffer
+	var outcome string
+
+	dec := json.NewDecoder(r)
+	for {
+		var ev testEvent
+		err := dec.Decode(&ev)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// not an event, keep the rest as is
+			io.Copy(out, io.MultiReader(dec.Buffered(), r))
+			break
+		}
+
+		if ev.Test == "" {
+			switch ev.Action {
+			case "output":
+				out.WriteString(ev.Output)
+			case "pass", "fail", "skip":
+				outcome = ev.Action
+			}
+			continue
+		}
+		i, ok := index[ev.Test]
+		if !ok {
+			i = len(tests)
+			index[ev.Test] = i
+			tests = append(tests, TestResult{Name: ev.Test})
+			outputs = append(outputs, new(bytes.Buffer))
+		}
+		switch ev.Action {
+		case "output":
+			outputs[i].WriteString(ev.Output)
+		case "pass", "fail", "skip":
+			tests[i].Outcome = ev.Action
+			tests[i].Time = time.Duration(ev.Elapsed * float64(time.Second))
+		}
+	}
+	for i := range tests {
+		// benchmarks only end with the package
+		if tests[i].Outcome == "" {
+			tests[i].Outcome = outcome
+		}
+		tests[i].Output = getStringBuffer(outputs[i])
+	}
+	return tests
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// public class Foo {
+// final class Foo {
+// public static void main(String[] args)
+// static public void main(String... args)
+
+const (
+	javaClassPtn = "\\b((?:public|final|abstract|strictfp)\\s+)*class\\s+(\\w+)"
+	javaMainPtn  = "(public\\s+static|static\\s+public)\\s+void\\s+main\\s*\\("
+)
+
+var (
+	javaClassRe = regexp.MustCompile(javaClassPtn)
+	javaMainRe  = regexp.MustCompile(javaMainPtn)
+)
+
+// Compile and run Java code with javac and java
+type Java struct {
+	sandboxed
+	path  string
+	java  string
+	heap  string
+	class string
+}
+
+func (j *Java) Name() string {
+	return "Java"
+}
+
+func (j *Java) Version() string {
+	var out bytes.Buffer
+
+	// older javac prints its version to stderr
+	err := runLocal(j.path, []string{"-version"}, ".", nil, &out, &out)
+	if err != nil {
+		return "Unknown"
+	}
+	return out.String()
+}
+
+func (j *Java) Init() error {
+	var err error
+
+	j.path, err = exec.LookPath("javac")
+	if err != nil {
+		return err
+	}
+	j.java, err = exec.LookPath("java")
+	if err != nil {
+		return err
+	}
+	j.heap = fmt.Sprintf("-Xmx%dm", MemoryLimit)
+	j.class = "Main"
+	return nil
+}
+
+func (j *Java) Compile(req *Args) *Result {
+	prog, result := j.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, prog.Args[len(prog.Args)-1]+": ", result)
+}
+
+// Build compiles the classes, the program runs the class holding main
+func (j *Java) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
+	var stdout, stderr bytes.Buffer
+	var args []string
+	var dir string
+	var id string
+
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(j, req.Mode)
+	}
+	code := req.Code
+
+	// javac insists that a public class lives in a file of the same name
+	class, main := j.detectClass(code)
+	fsrc := class + ".java"
+
+	dir, id, err = setupWorkspace(j, fsrc, code, req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	args = []string{"-d", ".", fsrc}
+	err = j.runBuild(j.path, args, nil, nil, dir, nil, &stdout, &stderr)
+	result.Cmd = strings.Join(append([]string{"javac"}, args...), " ")
+	result.C_Output, result.C_Error =
+		getStringBuffer(&stdout), getStringBuffer(&stderr)
+	if err != nil {
+		result.Error = "javac: " + err.Error()
+		return nil, &result
+	}
+	if main == "" {
+		return nil, &result
+	}
+
+	return &Program{sandboxed: j.sandboxed,
+		Dir: dir, Id: id, Name: j.java,
+		Args:    []string{j.heap, "-cp", ".", main},
+		Seccomp: SeccompRuntime}, &result
+}
+
+// detectClass returns the class that names the source file and the
+// class holding the main method, which is empty if there is none.
+// The source file is named after the public class if one is declared,
+// otherwise after the class containing main.
+func (j *Java) detectClass(code string) (string, string) {
+	var file, main string
+	var classes []javaClass
+
+	// comments and literals may mention classes too
+	code = javaStrip(code)
+	for _, m := range javaClassRe.FindAllStringSubmatchIndex(code, -1) {
+		c := javaClass{name: code[m[4]:m[5]]}
+		c.open, c.close = javaBody(code, m[1])
+		for _, outer := range classes {
+			if outer.open < m[0] && m[0] < outer.close {
+				c.name = outer.name + "$" + c.name
+				c.nested = true
+			}
+		}
+		if file == "" && !c.nested &&
+			strings.Contains(code[m[0]:m[4]], "public") {
+			file = c.name
+		}
+		classes = append(classes, c)
+	}
+
+	// main belongs to the innermost class whose body holds it
+	loc := javaMainRe.FindStringIndex(code)
+	if loc != nil {
+		open := -1
+		for _, c := range classes {
+			if c.open < loc[0] && loc[0] < c.close && c.open > open {
+				main, open = c.name, c.open
+			}
+		}
+	}
+	if file == "" && main != "" {
+		file = strings.SplitN(main, "$", 2)[0]
+	}
+	if file == "" {
+		file = j.class
+	}
+	return file, main
+}
+
+// javaClass is a class declaration and the offsets of its braces, the
+// name of a nested class is prefixed with the classes enclosing it
+type javaClass struct {
+	name        string
+	nested      bool
+	open, close int
+}
+
+// javaBody returns the offsets of the braces of the body starting after
+// offset from, close is the length of the code if the body is not closed
+func javaBody(code string, from int) (int, int) {
+	var depth int
+
+	open := strings.IndexByte(code[from:], '{')
+	if open < 0 {
+		return len(code), len(code)
+	}
+	open += from
+	for i := open; i < len(code); i++ {
+		switch code[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return open, i
+			}
+		}
+	}
+	return open, len(code)
+}
+
+// javaStrip blanks the comments, string and character literals of the
+// code, keeping the offsets of the rest
+func javaStrip(code string) string {
+	b := []byte(code)
+	blank := func(from, to int) {
+		for i := from; i < to && i < len(b); i++ {
+			if b[i] != '\n' {
+				b[i] = ' '
+			}
+		}
+	}
+	// end returns the offset after the closing delimiter
+	end := func(from int, delim string, escapes bool) int {
+		for i := from; i < len(code); i++ {
+			if escapes && code[i] == '\\' {
+				i++
+				continue
+			}
+			if strings.HasPrefix(code[i:], delim) {
+				return i + len(delim)
+			}
+		}
+		return len(code)
+	}
+	for i := 0; i < len(code); {
+		var next int
+		switch {
+		case strings.HasPrefix(code[i:], "//"):
+			next = end(i, "\n", false)
+		case strings.HasPrefix(code[i:], "/*"):
+			next = end(i+2, "*/", false)
+		case strings.HasPrefix(code[i:], `"""`):
+			next = end(i+3, `"""`, true)
+		case code[i] == '"' || code[i] == '\'':
+			next = end(i+1, code[i:i+1], true)
+		default:
+			i++
+			continue
+		}
+		blank(i, next)
+		i = next
+	}
+	return string(b)
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// fun main()
+// fun main(args: Array<String>)
+
+const kotlinMainPtn = "fun\\s+main\\s*\\("
+
+var kotlinMainRe = regexp.MustCompile(kotlinMainPtn)
+
+// Compile Kotlin code with kotlinc and run it on the JVM
+type Kotlin struct {
+	sandboxed
+	path string
+	java string
+	heap string
+	fsrc string
+	fjar string
+}
+
+func (k *Kotlin) Name() string {
+	return "Kotlin"
+}
+
+func (k *Kotlin) Version() string {
+	var out bytes.Buffer
+
+	err := runLocal(k.path, []string{"-version"}, ".", nil, &out, &out)
+	if err != nil {
+		return "Unknown"
+	}
+	return out.String()
+}
+
+func (k *Kotlin) Init() error {
+	var err error
+
+	k.path, err = exec.LookPath("kotlinc")
+	if err != nil {
+		return err
+	}
+	k.java, err = exec.LookPath("java")
+	if err != nil {
+		return err
+	}
+	k.heap = fmt.Sprintf("-Xmx%dm", MemoryLimit)
+	k.fsrc = "prog.kt"
+	k.fjar = "prog.jar"
+	return nil
+}
+
+func (k *Kotlin) Compile(req *Args) *Result {
+	prog, result := k.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, k.fjar+": ", result)
+}
+
+// Build compiles the code, into a jar with the runtime if it has main
+func (k *Kotlin) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
+	var stdout, stderr bytes.Buffer
+	var args []string
+	var dir string
+	var id string
+
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(k, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(k, k.fsrc, code, req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	main := kotlinMainRe.FindString(code) != ""
+	if main {
+		args = []string{k.fsrc, "-include-runtime", "-d", k.fjar}
+	} else {
+		args = []string{k.fsrc, "-d", "."}
+	}
+	err = k.runBuild(k.path, args, nil, nil, dir, nil, &stdout, &stderr)
+	result.Cmd = strings.Join(append([]string{"kotlinc"}, args...), " ")
+	result.C_Output, result.C_Error =
+		getStringBuffer(&stdout), getStringBuffer(&stderr)
+	if err != nil {
+		result.Error = "kotlinc: " + err.Error()
+		return nil, &result
+	}
+	if !main {
+		return nil, &result
+	}
+
+	return &Program{sandboxed: k.sandboxed,
+		Dir: dir, Id: id, Name: k.java,
+		Args:    []string{k.heap, "-jar", k.fjar},
+		Seccomp: SeccompRuntime}, &result
+}
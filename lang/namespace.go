@@ -0,0 +1,520 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The namespace sandbox runs the processes in user, mount, pid, network,
+// ipc and uts namespaces of their own, without runc and without
+// privileges. They see the rootfs read-only, only the workspace and
+// /tmp are writable, and run under the seccomp profile of the command.
+
+const (
+	// The rootfs seen through the namespace sandbox
+	nsRootfs   = "/"
+	nsHostname = "lotsawa"
+	nsTmpSize  = 64 << 20
+
+	// Limits of the sandboxed processes
+	nsMaxFiles    = 1024
+	nsMaxProcs    = 512
+	nsMaxFileSize = 256 << 20
+)
+
+// The directories of the rootfs replaced by the sandbox's own
+var nsSkip = map[string]bool{
+	"dev":  true,
+	"proc": true,
+	// the sockets of the services of the host
+	"run": true,
+	"sys": true,
+	"tmp": true,
+}
+
+// The devices of the host bound into the sandbox
+var nsDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// Not in package syscall
+const (
+	prSetDumpable        = 4
+	capSetpcap           = 8
+	capSysAdmin          = 21
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+	rlimitNproc          = 6
+)
+
+// Namespaces runs the commands in namespaces of their own
+type Namespaces struct {
+	rootfs string
+}
+
+// nsSpec is what the init of the sandbox sets up and runs
+type nsSpec struct {
+	// The empty directory the root is built in
+	Root      string
+	Rootfs    string
+	Workspace string
+	// Host directories bound read-only at the same path
+	Binds []string
+	// Memory limit in megabytes, and cpu time limit in seconds
+	Memory int
+	CPU    int
+	// The syscalls seccomp denies to the command, by number on the
+	// audit architecture Arch, none without Arch
+	Arch   uint32
+	Denied []uint32
+	Name   string
+	Args   []string
+}
+
+func init() {
+	if len(os.Args) > 2 && os.Args[1] == "nsinit" {
+		runtime.LockOSThread()
+		err := nsInit(os.Args[2])
+		fmt.Fprintln(os.Stderr, "sandbox:", err)
+		os.Exit(127)
+	}
+}
+
+// NewNamespaces returns the namespace sandbox once it ran a command
+func NewNamespaces() (*Namespaces, error) {
+	var stderr strings.Builder
+
+	n := &Namespaces{rootfs: nsRootfs}
+	dir, err := ioutil.TempDir(DataStore, "sandbox")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	err = n.Prepare(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer n.Cleanup(dir)
+	err = n.Exec(&Command{
+		Name:    "true",
+		Dir:     dir,
+		Stderr:  &stderr,
+		Timeout: RunTimeout * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return n, nil
+}
+
+func (n *Namespaces) Name() string {
+	return SandboxNamespaces
+}
+
+// Prepare hands the workspace to the sandbox user, and makes the
+// directory the root is built in
+func (n *Namespaces) Prepare(dir string) error {
+	err := giveAway(dir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir+"-root", 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (n *Namespaces) Cleanup(dir string) error {
+	return os.RemoveAll(dir + "-root")
+}
+
+// Exec runs the command in new namespaces, under timeout
+func (n *Namespaces) Exec(c *Command) error {
+	var spec nsSpec
+	var cmd *exec.Cmd
+
+	workspace, err := filepath.Abs(c.Dir)
+	if err != nil {
+		return err
+	}
+	memory := c.Memory
+	if memory == 0 {
+		memory = MemoryLimit
+	}
+	spec = nsSpec{
+		Root:      workspace + "-root",
+		Rootfs:    n.rootfs,
+		Workspace: workspace,
+		Binds:     c.Binds,
+		Memory:    memory,
+		CPU:       int(c.Timeout.Seconds()) + 1,
+		Name:      c.Name,
+		Args:      c.Args,
+	}
+	if c.Seccomp != "" {
+		// the sandbox refuses a profile it can not enforce
+		spec.Denied, err = seccompSyscalls(c.Seccomp)
+		if err != nil {
+			return err
+		}
+		spec.Arch = seccompArch
+	}
+	data, err := json.Marshal(&spec)
+	if err != nil {
+		return err
+	}
+
+	// the sandbox user is the only one in the namespace, it is the
+	// user running the server unless the server may switch to it
+	uid, gid := os.Geteuid(), os.Getegid()
+	if privileged() {
+		uid, gid = SandboxUid, SandboxGid
+	}
+	cmd = exec.Command("/proc/self/exe", "nsinit", string(data))
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, c.Env...)
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID | syscall.CLONE_NEWNET |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: SandboxUid, HostID: uid, Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: SandboxGid, HostID: gid, Size: 1},
+		},
+		Credential: &syscall.Credential{
+			Uid:         SandboxUid,
+			Gid:         SandboxGid,
+			NoSetGroups: true,
+		},
+		// to set up the mounts, dropped before running the command
+		AmbientCaps: []uintptr{capSetpcap, capSysAdmin},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	cmd.ExtraFiles = []*os.File{wr}
+
+	audit := openSeccompLog()
+	defer audit.Close()
+	err = waitTimed(cmd, c.Timeout)
+	wr.Close()
+
+	report := readReport(rd)
+	if report == nil {
+		return err
+	}
+	if report.Signal == int(syscall.SIGSYS) {
+		call, _ := audit.denied(c.Name)
+		return &seccompError{call}
+	}
+	return report.error(err, memory)
+}
+
+// nsInit builds the root of the sandbox, enters it and runs the command
+// with no capabilities left
+func nsInit(arg string) error {
+	var spec nsSpec
+
+	err := json.Unmarshal([]byte(arg), &spec)
+	if err != nil {
+		return err
+	}
+	root := spec.Root
+
+	// nothing mounted from here on reaches the host
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("private mounts: %s", err)
+	}
+	err = syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mount root: %s", err)
+	}
+	err = mountTmpfs(filepath.Join(root, "tmp"))
+	if err != nil {
+		return err
+	}
+
+	// the directories of the rootfs leading to the workspace and the
+	// binds are replaced by the paths to them
+	holes := make(map[string]bool)
+	for _, dir := range append(spec.Binds, spec.Workspace) {
+		top := strings.SplitN(strings.TrimPrefix(dir, "/"), "/", 2)[0]
+		holes[top] = true
+	}
+	entries, err := ioutil.ReadDir(spec.Rootfs)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if holes[name] || nsSkip[name] {
+			continue
+		}
+		src := filepath.Join(spec.Rootfs, name)
+		dst := filepath.Join(root, name)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(src)
+			if err == nil {
+				err = os.Symlink(link, dst)
+			}
+			if err != nil {
+				return err
+			}
+		case fi.IsDir():
+			err = bindMount(src, dst, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = mountDevices(filepath.Join(root, "dev"))
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(filepath.Join(root, "proc"), 0555)
+	if err == nil {
+		err = syscall.Mount("proc", filepath.Join(root, "proc"), "proc",
+			syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mount proc: %s", err)
+	}
+	for _, dir := range spec.Binds {
+		err = bindMount(dir, filepath.Join(root, dir), true)
+		if err != nil {
+			return err
+		}
+	}
+	err = bindMount(spec.Workspace, filepath.Join(root, spec.Workspace),
+		false)
+	if err != nil {
+		return err
+	}
+
+	// the old root goes away under the new one
+	err = syscall.Chdir(root)
+	if err == nil {
+		err = syscall.PivotRoot(".", ".")
+	}
+	if err == nil {
+		err = syscall.Unmount(".", syscall.MNT_DETACH)
+	}
+	if err != nil {
+		return fmt.Errorf("pivot root: %s", err)
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY,
+		"")
+	if err != nil {
+		return fmt.Errorf("read-only root: %s", err)
+	}
+	err = syscall.Chdir(spec.Workspace)
+	if err != nil {
+		return err
+	}
+	err = syscall.Sethostname([]byte(nsHostname))
+	if err != nil {
+		return err
+	}
+
+	err = nsLimits(&spec)
+	if err != nil {
+		return err
+	}
+	err = dropCapabilities()
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(spec.Name)
+	if err != nil {
+		return err
+	}
+	// last, the filter applies to this thread and what it executes
+	if spec.Arch != 0 {
+		err = seccompInstall(spec.Arch, spec.Denied)
+		if err != nil {
+			return err
+		}
+	}
+	return runReported(path, append([]string{spec.Name}, spec.Args...))
+}
+
+func mountTmpfs(dir string) error {
+	err := os.Mkdir(dir, 01777)
+	if err == nil {
+		err = syscall.Mount("tmpfs", dir, "tmpfs",
+			syscall.MS_NOSUID|syscall.MS_NODEV,
+			fmt.Sprintf("mode=1777,size=%d", nsTmpSize))
+	}
+	if err != nil {
+		return fmt.Errorf("mount %s: %s", dir, err)
+	}
+	return nil
+}
+
+// mountDevices binds the devices of the host into dir
+func mountDevices(dir string) error {
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, name := range nsDevices {
+		err = bindMount(filepath.Join("/dev", name),
+			filepath.Join(dir, name), false)
+		if err != nil {
+			return err
+		}
+	}
+	for name, link := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		err = os.Symlink(link, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The flags of a mount that a remount has to keep, by their statfs
+// flags
+var lockedFlags = map[int64]uintptr{
+	1:    syscall.MS_RDONLY,
+	2:    syscall.MS_NOSUID,
+	4:    syscall.MS_NODEV,
+	8:    syscall.MS_NOEXEC,
+	1024: syscall.MS_NOATIME,
+	2048: syscall.MS_NODIRATIME,
+	4096: syscall.MS_RELATIME,
+}
+
+// bindMount binds src at dst, creating the mount point
+func bindMount(src, dst string, readonly bool) error {
+	var st syscall.Statfs_t
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = os.MkdirAll(dst, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(dst, nil, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("bind %s: %s", src, err)
+	}
+	if !readonly {
+		return nil
+	}
+
+	// the flags locked by the namespace can not be dropped
+	err = syscall.Statfs(dst, &st)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for f, ms := range lockedFlags {
+		if st.Flags&f != 0 {
+			flags |= ms
+		}
+	}
+	if flags&(syscall.MS_NOATIME|syscall.MS_RELATIME) == 0 {
+		flags |= syscall.MS_STRICTATIME
+	}
+	err = syscall.Mount("", dst, "", flags, "")
+	if err != nil {
+		return fmt.Errorf("read-only %s: %s", src, err)
+	}
+	return nil
+}
+
+// nsLimits sets the resource limits of the command, never above the
+// limits the sandbox already has
+func nsLimits(spec *nsSpec) error {
+	limits := []struct {
+		resource int
+		max      uint64
+	}{
+		{syscall.RLIMIT_DATA, uint64(spec.Memory) << 20},
+		{syscall.RLIMIT_CPU, uint64(spec.CPU)},
+		{syscall.RLIMIT_FSIZE, nsMaxFileSize},
+		{syscall.RLIMIT_NOFILE, nsMaxFiles},
+		{rlimitNproc, nsMaxProcs},
+		{syscall.RLIMIT_CORE, 0},
+	}
+	for _, l := range limits {
+		var rl syscall.Rlimit
+
+		err := syscall.Getrlimit(l.resource, &rl)
+		if err != nil {
+			return err
+		}
+		if l.max < rl.Max {
+			rl.Max = l.max
+		}
+		rl.Cur = rl.Max
+		err = syscall.Setrlimit(l.resource, &rl)
+		if err != nil {
+			return fmt.Errorf("limit %d: %s", l.resource, err)
+		}
+	}
+	return nil
+}
+
+// dropCapabilities leaves the command no capability to gain, even from
+// setuid programs
+func dropCapabilities() error {
+	for c := uintptr(0); ; c++ {
+		_, _, e := syscall.RawSyscall(syscall.SYS_PRCTL,
+			syscall.PR_CAPBSET_DROP, c, 0)
+		if e == syscall.EINVAL {
+			break
+		}
+		if e != 0 {
+			return fmt.Errorf("drop capability %d: %s", c, e)
+		}
+	}
+	_, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient,
+		prCapAmbientClearAll, 0, 0, 0, 0)
+	if e != 0 {
+		return errors.New("clear ambient capabilities: " + e.Error())
+	}
+	_, _, e = syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1,
+		0, 0, 0, 0)
+	if e != 0 {
+		return errors.New("no_new_privs: " + e.Error())
+	}
+	return nil
+}
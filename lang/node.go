@@ -0,0 +1,245 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// The runner feeds the program to V8 one top-level statement at a
+// time, printing the value of each like the node REPL would. A
+// statement ends where both it and the rest of the program compile,
+// and function declarations run first as they are hoisted in a script.
+const nodeRunner = `
+const fs = require('fs');
+const util = require('util');
+const vm = require('vm');
+
+function report(e) {
+  const trace = String(e && e.stack || e).split('\n').filter(function(l) {
+    return l.indexOf(__filename) < 0 && !/\(?node:/.test(l);
+  });
+  console.error(trace.join('\n'));
+  process.exit(1);
+}
+
+function compile(code, start) {
+  return new vm.Script(code, { filename: file, lineOffset: start });
+}
+
+function compiles(code) {
+  try {
+    new vm.Script(code);
+    return true;
+  } catch (e) {
+    return false;
+  }
+}
+
+global.require = require;
+
+const file = process.argv[2];
+const lines = fs.readFileSync(file, 'utf8').split('\n');
+
+// a syntax error is reported against the whole program
+try {
+  compile(lines.join('\n'), 0);
+} catch (e) {
+  report(e);
+}
+
+const stmts = [];
+for (let start = 0; start < lines.length; ) {
+  let end = start + 1;
+  while (end < lines.length &&
+      !(compiles(lines.slice(start, end).join('\n')) &&
+        compiles(lines.slice(end).join('\n')))) {
+    end++;
+  }
+  stmts.push({ start: start, code: lines.slice(start, end).join('\n') });
+  start = end;
+}
+
+const decl = /^\s*(async\s+)?function\b/;
+const directive = /^\s*(['"])use strict\1;?\s*$/;
+const order = stmts.filter(function(s) { return decl.test(s.code); }).concat(
+    stmts.filter(function(s) { return !decl.test(s.code); }));
+for (const s of order) {
+  try {
+    const value = compile(s.code, s.start).runInThisContext();
+    if (value !== undefined && !directive.test(s.code)) {
+      console.log(util.inspect(value));
+    }
+  } catch (e) {
+    report(e);
+  }
+}
+`
+
+// Run JavaScript code with Node.js
+type Node struct {
+	sandboxed
+	path    string
+	heap    string
+	runner  string
+	frunner string
+	fsrc    string
+}
+
+func (n *Node) Name() string {
+	return "Node"
+}
+
+func (n *Node) Version() string {
+	var stdout bytes.Buffer
+	err := runLocal(n.path, []string{"--version"}, ".", nil, &stdout, nil)
+	if err != nil {
+		return "Unknown"
+	}
+	return stdout.String()
+}
+
+func (n *Node) Init() error {
+	path, err := exec.LookPath("node")
+	if err != nil {
+		return err
+	}
+	n.path = path
+	n.heap = fmt.Sprintf("--max-old-space-size=%d", MemoryLimit)
+	n.runner = nodeRunner
+	n.frunner = "runner.js"
+	n.fsrc = "prog.js"
+	return nil
+}
+
+func (n *Node) Compile(req *Args) *Result {
+	prog, result := n.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, "", result)
+}
+
+// Build sets up the workspace, the program runs the code through the
+// runner
+func (n *Node) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
+	var dir string
+	var id string
+
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(n, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(n, n.fsrc, code, req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	return n.program(dir, id, n.fsrc, &result), &result
+}
+
+// program returns the program running the JavaScript file src in dir
+// through the runner, nil if the runner can not be written.
+func (n *Node) program(dir, id, src string, result *Result) *Program {
+	err := writeSource(fmt.Sprintf("%s/%s", dir, n.frunner), n.runner)
+	if err != nil {
+		result.Error = err.Error()
+		return nil
+	}
+
+	args := []string{n.heap, n.frunner, src}
+	if result.Cmd == "" {
+		result.Cmd = strings.Join(append([]string{"node"}, args...), " ")
+	}
+	return &Program{sandboxed: n.sandboxed,
+		Dir: dir, Id: id, Name: n.path, Args: args,
+		Seccomp: SeccompRuntime}
+}
+
+// Transpile TypeScript code with tsc, then run it with Node.js
+type TypeScript struct {
+	Node
+	tsc  string
+	fsrc string
+}
+
+func (ts *TypeScript) Name() string {
+	return "TypeScript"
+}
+
+func (ts *TypeScript) Version() string {
+	var stdout bytes.Buffer
+	err := runLocal(ts.tsc, []string{"--version"}, ".", nil, &stdout, nil)
+	if err != nil {
+		return "Unknown"
+	}
+	return stdout.String()
+}
+
+func (ts *TypeScript) Init() error {
+	if err := ts.Node.Init(); err != nil {
+		return err
+	}
+
+	path, err := exec.LookPath("tsc")
+	if err != nil {
+		return err
+	}
+	ts.tsc = path
+	ts.fsrc = "prog.ts"
+	return nil
+}
+
+func (ts *TypeScript) Compile(req *Args) *Result {
+	prog, result := ts.Build(req)
+	if prog == nil {
+		return result
+	}
+	return runProgram(prog, "", result)
+}
+
+// Build transpiles the code, the program runs the JavaScript with Node.js
+func (ts *TypeScript) Build(req *Args) (*Program, *Result) {
+	var result Result
+	var err error
+	var stdout, stderr bytes.Buffer
+	var args []string
+	var dir string
+	var id string
+
+	if req.Mode != ModeRun {
+		return nil, unsupportedMode(ts, req.Mode)
+	}
+	code := req.Code
+
+	dir, id, err = setupWorkspace(ts, ts.fsrc, code, req.Files)
+	result.Id = id
+	if err != nil {
+		log.Println("Failed to setup workspace:", err)
+		result.Error = err.Error()
+		return nil, &result
+	}
+
+	// tsc writes prog.js next to prog.ts
+	args = []string{"--target", "es2017", "--module", "commonjs", ts.fsrc}
+	err = ts.runBuild(ts.tsc, args, nil, nil, dir, nil, &stdout, &stderr)
+	result.Cmd = strings.Join(append([]string{"tsc"}, args...), " ")
+	result.C_Output, result.C_Error =
+		getStringBuffer(&stdout), getStringBuffer(&stderr)
+	if err != nil {
+		result.Error = "tsc: " + err.Error()
+		return nil, &result
+	}
+
+	return ts.program(dir, id, ts.Node.fsrc, &result), &result
+}
@@ -0,0 +1,534 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A plugin is a compiler living in another process. The server talks
+// to it with JSON-RPC 1.0, either over the stdin and stdout of a plugin
+// executable it starts, or over a socket the plugin listens on.
+// The plugin serves these methods:
+//
+//	Plugin.Init(struct{}, *string)
+//	Plugin.Name(struct{}, *string)
+//	Plugin.Version(struct{}, *string)
+//	Plugin.Start(PluginArgs, *string)
+//	Plugin.Read(string, *PluginOutput)
+//	Plugin.Ping(struct{}, *string)
+//
+// Start begins compiling and replies the ID of the job, the output of
+// the program is then streamed by calling Read with the ID until the
+// output holding the result. The arguments carry the version of the
+// protocol, a plugin refuses the versions newer than its own.
+//
+// ServePlugin implements the protocol for compilers written in Go.
+
+const (
+	pluginService = "Plugin"
+
+	// Timeout seconds for a plugin to answer a call. The calls of a
+	// compilation answer within the time given to build and run the
+	// program.
+	PluginTimeout = 10
+
+	// Seconds between health checks of a plugin.
+	PluginInterval = 10
+
+	// How long Read waits for output before replying without any
+	pluginPoll = time.Second
+)
+
+// PluginVersion is the version of the plugin protocol. PluginArgs only
+// gains fields along with a new version.
+const PluginVersion = 1
+
+// PluginArgs holds the arguments of the Plugin.Start call. It is kept
+// apart from Args, which changes with the server, to keep the protocol
+// stable.
+type PluginArgs struct {
+	// Version of the protocol the server speaks
+	Version int
+	// The code to compile
+	Code string
+	// What to produce, defaults to running the program
+	Mode string
+	// Optimization level of the produced code, such as "-O2"
+	Opt string
+	// Use intel syntax for the assembly code
+	Intel bool
+}
+
+// pluginArgs maps the arguments of a request onto the protocol, failing
+// if they do not fit in it
+func pluginArgs(req *Args) (*PluginArgs, error) {
+	if len(req.Flags) > 0 || len(req.Files) > 0 || req.Bench != "" ||
+		req.Race || req.Cover {
+		return nil, fmt.Errorf("protocol version %d only takes the code, "+
+			"the mode and the optimization", PluginVersion)
+	}
+	return &PluginArgs{
+		Version: PluginVersion,
+		Code:    req.Code,
+		Mode:    string(req.Mode),
+		Opt:     req.Opt,
+		Intel:   req.Intel,
+	}, nil
+}
+
+// args returns the arguments of the compiler
+func (a *PluginArgs) args() (*Args, error) {
+	if a.Version < 1 || a.Version > PluginVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, "+
+			"up to %d is", a.Version, PluginVersion)
+	}
+	return &Args{
+		Code:  a.Code,
+		Mode:  Mode(a.Mode),
+		Opt:   a.Opt,
+		Intel: a.Intel,
+	}, nil
+}
+
+// PluginOutput is what the program of a job printed since the last
+// Read, the result is set once the job is done.
+type PluginOutput struct {
+	Stdout string
+	Stderr string
+	Result *Result
+}
+
+// Streamer is implemented by the compilers able to stream the output of
+// the program while it runs, ServePlugin streams it to the server.
+type Streamer interface {
+	CompileStream(req *Args, stdout, stderr io.Writer) *Result
+}
+
+// Plugin is a compiler backed by an out of process plugin
+type Plugin struct {
+	path    string
+	network string
+	addr    string
+	name    string
+	version string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	client   *rpc.Client
+	starting bool
+	once     sync.Once
+}
+
+// NewPlugin returns a plugin that is started from the executable path.
+func NewPlugin(path string) *Plugin {
+	return &Plugin{path: path, name: path}
+}
+
+// DialPlugin returns a plugin that is listening on addr.
+func DialPlugin(network, addr string) *Plugin {
+	return &Plugin{network: network, addr: addr, name: addr}
+}
+
+func (p *Plugin) Name() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name
+}
+
+func (p *Plugin) Version() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
+
+func (p *Plugin) Init() error {
+	p.mu.Lock()
+	p.starting = true
+	p.mu.Unlock()
+
+	err := p.start()
+	if err != nil {
+		return err
+	}
+
+	p.once.Do(func() {
+		go p.watch()
+	})
+	return nil
+}
+
+func (p *Plugin) Compile(req *Args) *Result {
+	var result Result
+	var job string
+	var stdout, stderr bytes.Buffer
+
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	if client == nil {
+		return &Result{Error: p.name + ": plugin not running"}
+	}
+
+	args, err := pluginArgs(req)
+	if err != nil {
+		return &Result{Error: p.name + ": " + err.Error()}
+	}
+
+	// the plugin builds and runs the code, it answers meanwhile
+	timeout := PluginTimeout * time.Second
+	limit := (BuildTimeout + RunTimeout) * time.Second
+	deadline := time.Now().Add(limit)
+	err = p.call(client, "Start", args, &job, timeout)
+	for err == nil {
+		var out PluginOutput
+
+		err = p.call(client, "Read", job, &out, timeout)
+		if err != nil {
+			break
+		}
+		stdout.WriteString(out.Stdout)
+		stderr.WriteString(out.Stderr)
+		if out.Result != nil {
+			result = *out.Result
+			break
+		}
+		if time.Now().After(deadline) {
+			result.Error = fmt.Sprintf("%s: compile timed out after %s",
+				p.name, limit)
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("plugin %s: %s", p.name, err)
+		// the other jobs go down with the plugin, it is only restarted
+		// when it does not answer anymore
+		_, ok := err.(rpc.ServerError)
+		if !ok && !p.alive(client) {
+			p.restart(client)
+		}
+		result.Error = p.name + ": " + err.Error()
+	}
+	result.P_Output = getStringBuffer(&stdout)
+	result.P_Error = getStringBuffer(&stderr)
+	return &result
+}
+
+// start the plugin and handshake with it, p.starting must be set. The
+// handshake is made without p.mu, the client is set once it succeeded.
+func (p *Plugin) start() error {
+	var err error
+	var cmd *exec.Cmd
+	var client *rpc.Client
+	var name, version, ok string
+
+	if p.path != "" {
+		cmd, client, err = p.exec()
+	} else {
+		var conn net.Conn
+		conn, err = net.Dial(p.network, p.addr)
+		if err == nil {
+			client = jsonrpc.NewClient(conn)
+		}
+	}
+	if err == nil {
+		timeout := PluginTimeout * time.Second
+		err = p.call(client, "Init", struct{}{}, &ok, timeout)
+		if err == nil {
+			err = p.call(client, "Name", struct{}{}, &name, timeout)
+		}
+		if err == nil {
+			err = p.call(client, "Version", struct{}{}, &version, timeout)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starting = false
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+		return err
+	}
+	p.cmd, p.client = cmd, client
+	p.name, p.version = name, version
+	return nil
+}
+
+// start the plugin executable with its stdio as the connection
+func (p *Plugin) exec() (*exec.Cmd, *rpc.Client, error) {
+	cmd := exec.Command(p.path)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := jsonrpc.NewClient(&pipe{r, w})
+	go func() {
+		cmd.Wait()
+		// give a crashing plugin a moment before bringing it back
+		time.Sleep(time.Second)
+		p.restart(client)
+	}()
+	return cmd, client, nil
+}
+
+// stop the plugin, p.mu must be held
+func (p *Plugin) stop() {
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		p.cmd = nil
+	}
+}
+
+// restart the plugin unless someone else already did since client
+// was taken
+func (p *Plugin) restart(client *rpc.Client) {
+	p.mu.Lock()
+	if p.client != client || p.starting {
+		p.mu.Unlock()
+		return
+	}
+	log.Printf("restarting plugin %s", p.name)
+	p.stop()
+	p.starting = true
+	p.mu.Unlock()
+
+	err := p.start()
+	if err != nil {
+		log.Printf("plugin %s restart failed: %s", p.Name(), err)
+	}
+}
+
+// watch checks the plugin periodically and restarts it when it stops
+// answering
+func (p *Plugin) watch() {
+	for range time.Tick(PluginInterval * time.Second) {
+		p.mu.Lock()
+		client := p.client
+		p.mu.Unlock()
+
+		if client != nil && p.alive(client) {
+			continue
+		}
+		p.restart(client)
+	}
+}
+
+// alive pings the plugin through client
+func (p *Plugin) alive(client *rpc.Client) bool {
+	var pong string
+
+	err := p.call(client, "Ping", struct{}{}, &pong,
+		PluginTimeout*time.Second)
+	if err != nil {
+		log.Printf("plugin %s health check failed: %s", p.Name(), err)
+	}
+	return err == nil
+}
+
+// call a method of the plugin, giving up after timeout. The client is
+// closed on timeout, so that a late answer is not written to reply.
+func (p *Plugin) call(client *rpc.Client, method string,
+	args interface{}, reply interface{}, timeout time.Duration) error {
+	call := client.Go(pluginService+"."+method, args, reply, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		client.Close()
+		<-call.Done
+		return fmt.Errorf("%s timed out after %s", method, timeout)
+	}
+}
+
+// pipe joins the stdout and stdin of a plugin into a connection
+type pipe struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c *pipe) Close() error {
+	err := c.WriteCloser.Close()
+	if e := c.ReadCloser.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// pluginServer exposes a compiler with the plugin protocol
+type pluginServer struct {
+	c Compiler
+
+	mu   sync.Mutex
+	jobs map[string]*pluginJob
+	last int
+}
+
+// pluginJob is a compile job of a plugin server, collecting the output
+// of the program until it is read
+type pluginJob struct {
+	mu     sync.Mutex
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	result *Result
+	// signaled when there is something to read
+	ready chan struct{}
+}
+
+// jobWriter writes to a buffer of the job
+type jobWriter struct {
+	job *pluginJob
+	buf *bytes.Buffer
+}
+
+func (w *jobWriter) Write(b []byte) (int, error) {
+	w.job.mu.Lock()
+	defer w.job.mu.Unlock()
+	w.job.signal()
+	return w.buf.Write(b)
+}
+
+// signal the reader of the job, j.mu must be held
+func (j *pluginJob) signal() {
+	select {
+	case j.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *pluginServer) Name(args struct{}, reply *string) error {
+	*reply = s.c.Name()
+	return nil
+}
+
+func (s *pluginServer) Version(args struct{}, reply *string) error {
+	*reply = s.c.Version()
+	return nil
+}
+
+func (s *pluginServer) Init(args struct{}, reply *string) error {
+	return s.c.Init()
+}
+
+func (s *pluginServer) Start(pargs PluginArgs, reply *string) error {
+	args, err := pargs.args()
+	if err != nil {
+		return err
+	}
+	job := &pluginJob{ready: make(chan struct{}, 1)}
+
+	s.mu.Lock()
+	s.last++
+	id := strconv.Itoa(s.last)
+	s.jobs[id] = job
+	s.mu.Unlock()
+
+	go func() {
+		var res *Result
+
+		if st, ok := s.c.(Streamer); ok {
+			res = st.CompileStream(args, &jobWriter{job, &job.stdout},
+				&jobWriter{job, &job.stderr})
+		} else {
+			res = s.c.Compile(args)
+		}
+		if res == nil {
+			res = &Result{Error: "no result"}
+		}
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		if _, ok := s.c.(Streamer); !ok {
+			job.stdout.WriteString(res.P_Output)
+			job.stderr.WriteString(res.P_Error)
+		}
+		res.P_Output, res.P_Error = "", ""
+		job.result = res
+		job.signal()
+	}()
+
+	*reply = id
+	return nil
+}
+
+func (s *pluginServer) Read(id string, reply *PluginOutput) error {
+	s.mu.Lock()
+	job := s.jobs[id]
+	s.mu.Unlock()
+	if job == nil {
+		return errors.New("unknown job " + id)
+	}
+
+	select {
+	case <-job.ready:
+	case <-time.After(pluginPoll):
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	reply.Stdout = job.stdout.String()
+	reply.Stderr = job.stderr.String()
+	job.stdout.Reset()
+	job.stderr.Reset()
+	if job.result != nil {
+		reply.Result = job.result
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *pluginServer) Ping(args struct{}, reply *string) error {
+	*reply = "pong"
+	return nil
+}
+
+// ServePlugin serves c with the plugin protocol on conn until the
+// connection is closed. Plugin executables pass their stdin and stdout
+// joined with StdioConn.
+func ServePlugin(c Compiler, conn io.ReadWriteCloser) error {
+	s := rpc.NewServer()
+	err := s.RegisterName(pluginService, &pluginServer{c: c,
+		jobs: make(map[string]*pluginJob)})
+	if err != nil {
+		return err
+	}
+	s.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
+
+// StdioConn returns the connection of a plugin executable to the server.
+func StdioConn() io.ReadWriteCloser {
+	return &pipe{os.Stdin, os.Stdout}
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setpriv drops the privileges on the host, without it the server can
+// only switch to the sandbox user
+var setpriv, _ = exec.LookPath("setpriv")
+
+// privileged reports whether the server can switch to the sandbox
+// user
+func privileged() bool {
+	return os.Geteuid() == 0
+}
+
+// giveAway hands the files under dir to the sandbox user, so that what
+// is sandboxed can write its workspace and nothing else of the server
+func giveAway(dir string) error {
+	if !privileged() {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, SandboxUid, SandboxGid)
+	})
+}
+
+// unprivileged makes the command run on the host as the sandbox user,
+// without capabilities and with no_new_privs set
+func unprivileged(cmd *exec.Cmd) {
+	if setpriv == "" {
+		if privileged() {
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: &syscall.Credential{
+					Uid: SandboxUid,
+					Gid: SandboxGid,
+				},
+			}
+		}
+		return
+	}
+
+	opts := []string{setpriv, "--no-new-privs", "--inh-caps=-all"}
+	if privileged() {
+		opts = append(opts,
+			"--reuid="+strconv.Itoa(SandboxUid),
+			"--regid="+strconv.Itoa(SandboxGid),
+			"--clear-groups", "--bounding-set=-all")
+	}
+	cmd.Args = append(append(opts, "--"), cmd.Args...)
+	cmd.Path = setpriv
+}
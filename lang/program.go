@@ -0,0 +1,123 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Builder is implemented by the compilers that can build a program
+// once and run it many times, that is all but the plugins.
+type Builder interface {
+	Compiler
+
+	// Build the code into a program. The result holds the compiler's
+	// output, the program is nil if the build failed or if there is
+	// nothing to run.
+	Build(*Args) (*Program, *Result)
+}
+
+// Program is a built program
+type Program struct {
+	// The sandbox of the compiler that built the program
+	sandboxed
+	// The workspace the program is built in
+	Dir string
+	// Unique compiling ID
+	Id string
+	// The command running the program, and its arguments
+	Name string
+	Args []string
+	// The seccomp profile the program runs under
+	Seccomp string
+	// The program builds itself, it runs with the limits of the builds
+	// instead
+	Build bool
+}
+
+// Run the program in its workspace with extra arguments, killing it
+// after timeout.
+func (p *Program) Run(stdin io.Reader, args []string,
+	stdout, stderr io.Writer, timeout time.Duration) error {
+	return p.RunLimited(stdin, args, stdout, stderr, timeout, MemoryLimit)
+}
+
+// RunLimited runs the program like Run, limiting its memory to memory
+// megabytes.
+func (p *Program) RunLimited(stdin io.Reader, args []string,
+	stdout, stderr io.Writer, timeout time.Duration, memory int) error {
+	args = append(p.Args[:len(p.Args):len(p.Args)], args...)
+	if p.Build {
+		return p.runBuild(p.Name, args, nil, nil, p.Dir, stdin,
+			stdout, stderr)
+	}
+	return p.runLimited(p.Name, args, p.Dir, stdin, stdout, stderr, timeout,
+		memory, p.Seccomp)
+}
+
+// runProgram runs the program once with the limits of the programs and
+// puts its output in the result, its error after label
+func runProgram(prog *Program, label string, result *Result) *Result {
+	var stdout, stderr bytes.Buffer
+
+	err := prog.Run(nil, nil, &stdout, &stderr, RunTimeout*time.Second)
+	if err != nil {
+		log.Println("error run:", err)
+		result.Error = label + err.Error()
+	}
+	result.P_Output, result.P_Error =
+		getStringBuffer(&stdout), getStringBuffer(&stderr)
+	return result
+}
+
+// timeoutError is returned when a program is killed for running out
+// of time
+type timeoutError struct {
+	after time.Duration
+	state string
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("program killed after %s:%s", e.after, e.state)
+}
+
+// IsTimeout reports whether err comes from a program killed for
+// running out of time.
+func IsTimeout(err error) bool {
+	_, ok := err.(*timeoutError)
+	return ok
+}
+
+// memoryError is returned when a program is killed or fails for
+// running out of memory
+type memoryError struct {
+	limit int
+}
+
+func (e *memoryError) Error() string {
+	return fmt.Sprintf("program ran out of memory, the limit is %d MB",
+		e.limit)
+}
+
+// IsOutOfMemory reports whether err comes from a program that ran out
+// of memory. A program killed by a signal, even SIGKILL, is not out of
+// memory unless its sandbox saw it reach the limit.
+func IsOutOfMemory(err error) bool {
+	_, ok := err.(*memoryError)
+	return ok
+}
+
+// outOfMemory turns the error of a program limited to memory megabytes
+// into a memoryError when it failed with the most it used, maxrss
+// kilobytes, close to the limit, which is all a rlimit tells: the
+// allocation over it fails and the program dies as it may.
+func outOfMemory(err error, maxrss int64, memory int) error {
+	if err == nil || memory <= 0 || maxrss < int64(memory)<<10*3/4 {
+		return err
+	}
+	return &memoryError{memory}
+}
@@ -3,216 +3,181 @@
 package lang
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"log"
-	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
-	"runtime"
-	"syscall"
 	"time"
-
-	"github.com/opencontainers/runc/libcontainer"
-	"github.com/opencontainers/runc/libcontainer/configs"
-	_ "github.com/opencontainers/runc/libcontainer/nsenter"
-	"github.com/opencontainers/runc/libcontainer/specconv"
-	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
-const (
-	fconf     = "libcontainer.json"
-	runc_root = "/run/lotsawa/runc"
-)
+// Sandbox runs the commands of the compilers, isolated from the host
+// as much as it can.
+type Sandbox interface {
+	// Name of the sandbox: "container", "namespaces" or "host"
+	Name() string
+	// Prepare the workspace for the commands run in it
+	Prepare(dir string) error
+	// Exec runs the command, killing it past its limits
+	Exec(cmd *Command) error
+	// Cleanup what Prepare left beside the workspace
+	Cleanup(dir string) error
+}
 
-var (
-	master_config *configs.Config
-	factory       libcontainer.Factory
-	use_container bool
+// The sandboxes, from the most isolated
+const (
+	SandboxContainer  = "container"
+	SandboxNamespaces = "namespaces"
+	SandboxHost       = "host"
 )
 
-func init() {
-	if len(os.Args) > 1 && os.Args[1] == "init" {
-		runtime.GOMAXPROCS(1)
-		runtime.LockOSThread()
-		factory, _ := libcontainer.New("")
-		if err := factory.StartInitialization(); err != nil {
-			log.Fatal(err)
-		}
-		panic("--this line should have never been executed, congratulations--")
-	}
+// Command is a command run in a sandbox
+type Command struct {
+	Name string
+	Args []string
+	// Extra environment variables
+	Env []string
+	// Host directories bound read-only at the same path
+	Binds []string
+	// The workspace the command runs in
+	Dir    string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// The command is killed after Timeout
+	Timeout time.Duration
+	// Memory limit in megabytes, 0 keeps the limit of the sandbox
+	Memory int
+	// The seccomp profile, if the sandbox supports seccomp
+	Seccomp string
 }
 
-func InitContainer() error {
-	var err error
-
-	err = os.MkdirAll(runc_root, 0700)
-	if err != nil {
-		return err
-	}
-	err = syscall.Access(runc_root, 0x7)
-	if err != nil {
-		return err
-	}
+// NewSandbox returns the named sandbox, once it is ready to run
+// commands.
+func NewSandbox(name string) (Sandbox, error) {
+	switch name {
+	case SandboxContainer:
+		return NewContainer()
+	case SandboxNamespaces:
+		return NewNamespaces()
+	case SandboxHost:
+		return new(Host), nil
+	}
+	return nil, errors.New("unknown sandbox " + name)
+}
 
-	factory, err = createFactory()
-	if err != nil {
-		return err
-	}
+// Host runs the commands on the host as the sandbox user, that is all
+// the isolation it has.
+type Host struct{}
 
-	master_config, err = loadConfig(fconf)
-	if err != nil {
-		return err
-	}
-	use_container = true
-	return nil
+func (h *Host) Name() string {
+	return SandboxHost
 }
 
-func loadConfig(path string) (*configs.Config, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("JSON specification file %s not found", path)
-		}
-		return nil, err
-	}
-	defer f.Close()
-	var spec *specs.Spec
-	if err = json.NewDecoder(f).Decode(&spec); err != nil {
-		return nil, err
-	}
-
-	var config *configs.Config
-	config, err = specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
-		CgroupName:       "",
-		UseSystemdCgroup: false,
-		NoPivotRoot:      true,
-		NoNewKeyring:     true,
-		Spec:             spec,
-	})
-	return config, nil
+func (h *Host) Prepare(dir string) error {
+	return giveAway(dir)
 }
 
-func createFactory() (libcontainer.Factory, error) {
-	abs, err := filepath.Abs(runc_root)
-	if err != nil {
-		return nil, err
-	}
-	return libcontainer.New(abs, libcontainer.Cgroupfs, func(l *libcontainer.LinuxFactory) error {
-		l.CriuPath = "criu"
-		return nil
-	})
+func (h *Host) Exec(cmd *Command) error {
+	return runLocalTimed(cmd.Name, cmd.Args, cmd.Env, cmd.Dir, cmd.Stdin,
+		cmd.Stdout, cmd.Stderr, cmd.Timeout, cmd.Memory)
 }
 
-func runContainer(name string,
-	args []string,
-	wd string,
-	stdin io.Reader,
-	stdout io.Writer,
-	stderr io.Writer) error {
-	var err error
-	var id string
+func (h *Host) Cleanup(dir string) error {
+	return nil
+}
 
-	id = path.Base(wd)
+// Sandboxed is implemented by the compilers running commands, they
+// run them on the host until they are given a sandbox.
+type Sandboxed interface {
+	SetSandbox(Sandbox)
+	// Sandbox returns the sandbox the compiler runs its commands in
+	Sandbox() Sandbox
+}
 
-	// mount base rootfs with working directory
-	rootfs := master_config.Rootfs
-	lowerdir := rootfs
-	upperdir, err := filepath.Abs(wd)
-	if err != nil {
-		return err
-	}
-	workdir, err := filepath.Abs(fmt.Sprintf("%s-%s", wd, "work"))
-	if err != nil {
-		return err
-	}
+// sandboxed is embedded by the compilers to run their commands in
+// their sandbox
+type sandboxed struct {
+	sb Sandbox
+}
 
-	err = os.Mkdir(workdir, 0775)
-	if err != nil && !os.IsExist(err) {
-		return err
-	}
-	defer os.RemoveAll(workdir)
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
-		lowerdir, upperdir, workdir)
-	err = syscall.Mount("overlay", upperdir, "overlay", syscall.MS_MGC_VAL,
-		opts)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err := syscall.Unmount(upperdir, 0)
-		if err != nil {
-			return
-		}
-	}()
-
-	// set cgroup path
-	var config configs.Config
-	config = *master_config
-	config.Cgroups.Path = fmt.Sprintf("%s/%s",
-		config.Cgroups.Path, id)
-	config.Rootfs = upperdir
-	container, err := factory.Create(id, &config)
-	if err != nil {
-		return err
-	}
-	defer container.Destroy()
-
-	args = append([]string{name}, args...)
-	process := &libcontainer.Process{
-		Args:   args,
-		Env:    []string{"PATH=/bin:/sbin:/usr/bin:/usr/sbin"},
-		User:   "root",
-		Stdin:  stdin,
-		Stdout: stdout,
-		Stderr: stderr,
-	}
+func (s *sandboxed) SetSandbox(sb Sandbox) {
+	s.sb = sb
+}
 
-	err = container.Run(process)
-	if err != nil {
-		return err
+func (s *sandboxed) Sandbox() Sandbox {
+	if s.sb == nil {
+		return new(Host)
 	}
+	return s.sb
+}
 
-	_, err = process.Wait()
+func (s *sandboxed) exec(cmd *Command) error {
+	sb := s.Sandbox()
+	err := sb.Prepare(cmd.Dir)
 	if err != nil {
 		return err
 	}
+	defer sb.Cleanup(cmd.Dir)
+	return sb.Exec(cmd)
+}
 
-	return nil
+// runTimed runs the program under the seccomp profile, killing it after
+// timeout or past the memory limit of the programs
+func (s *sandboxed) runTimed(name string,
+	args []string,
+	wd string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+	timeout time.Duration,
+	profile string) error {
+	return s.runLimited(name, args, wd, stdin, stdout, stderr, timeout,
+		MemoryLimit, profile)
 }
 
-func runContainerTimed(name string,
+// runLimited runs the program like runTimed, limiting its memory to
+// memory megabytes
+func (s *sandboxed) runLimited(name string,
 	args []string,
 	wd string,
 	stdin io.Reader,
 	stdout io.Writer,
 	stderr io.Writer,
-	timeout time.Duration) error {
-
-	sec := fmt.Sprintf("%d", int(timeout.Seconds()))
-	args = append([]string{"-k", "1", sec, name}, args...)
-	err := runContainer("timeout",
-		args,
-		wd,
-		stdin,
-		stdout,
-		stderr)
-
-	start := time.Now()
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			pst := ee.ProcessState
-			if st, ok := pst.Sys().(syscall.WaitStatus); ok {
-				if st.ExitStatus() == 124 {
-					err = fmt.Errorf("program killed after %s",
-						time.Now().Sub(start).String())
-				}
-			}
-		}
-		return err
-	}
+	timeout time.Duration,
+	memory int,
+	profile string) error {
+	return s.exec(&Command{
+		Name:    name,
+		Args:    args,
+		Dir:     wd,
+		Stdin:   stdin,
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Timeout: timeout,
+		Memory:  memory,
+		Seccomp: profile,
+	})
+}
 
-	return nil
+// runBuild runs a step of the build, such as the compiler, with the
+// time and memory limits of the builds
+func (s *sandboxed) runBuild(name string,
+	args []string,
+	env []string,
+	binds []string,
+	wd string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer) error {
+	return s.exec(&Command{
+		Name:    name,
+		Args:    args,
+		Env:     env,
+		Binds:   binds,
+		Dir:     wd,
+		Stdin:   stdin,
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Timeout: BuildTimeout * time.Second,
+		Memory:  BuildMemoryLimit,
+		Seccomp: SeccompRuntime,
+	})
 }
@@ -0,0 +1,236 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// The seccomp profiles of the sandboxed programs, an empty profile
+// keeps the one of libcontainer.json
+const (
+	// SeccompStrict denies the network along with the administration
+	// of the system, for the programs of compiled languages
+	SeccompStrict = "strict"
+	// SeccompRuntime leaves the sockets to the runtimes, such as Go's,
+	// the JVM and node
+	SeccompRuntime = "runtime"
+)
+
+// The syscalls no program has a use for
+var adminSyscalls = []string{
+	"ptrace", "process_vm_readv", "process_vm_writev",
+	"mount", "umount2", "pivot_root", "chroot",
+	"swapon", "swapoff", "reboot",
+	"kexec_load", "kexec_file_load",
+	"init_module", "finit_module", "delete_module",
+	"setns", "unshare",
+	"keyctl", "add_key", "request_key",
+	"acct", "settimeofday", "open_by_handle_at",
+	"perf_event_open", "bpf",
+}
+
+var seccompProfiles = map[string][]string{
+	SeccompStrict:  append([]string{"socket", "socketpair"}, adminSyscalls...),
+	SeccompRuntime: adminSyscalls,
+}
+
+// The names of the syscalls by number, and the audit number of the
+// architecture, for the architectures listing them
+var (
+	syscallNames map[int]string
+	seccompArch  uint32
+)
+
+// Not in package syscall
+const (
+	prSetSeccomp          = 22
+	seccompModeFilter     = 2
+	seccompRetKillProcess = 0x80000000
+	seccompRetAllow       = 0x7fff0000
+	// the syscalls of the x32 ABI, which would get around the filter
+	x32SyscallBit = 0x40000000
+)
+
+// ValidSeccomp reports whether name is a seccomp profile
+func ValidSeccomp(name string) bool {
+	_, ok := seccompProfiles[name]
+	return name == "" || ok
+}
+
+// seccompConfig returns the seccomp filter of the profile, killing the
+// process making a denied syscall
+func seccompConfig(profile string) *configs.Seccomp {
+	var filter configs.Seccomp
+
+	filter.DefaultAction = configs.Allow
+	for _, name := range seccompProfiles[profile] {
+		filter.Syscalls = append(filter.Syscalls, &configs.Syscall{
+			Name:   name,
+			Action: configs.Kill,
+		})
+	}
+	return &filter
+}
+
+// seccompSyscalls returns the numbers of the syscalls the profile
+// denies, an error if they are not known on this architecture
+func seccompSyscalls(profile string) ([]uint32, error) {
+	var denied []uint32
+
+	names, ok := seccompProfiles[profile]
+	if !ok {
+		return nil, errors.New("unknown seccomp profile " + profile)
+	}
+	if syscallNames == nil {
+		return nil, errors.New("no seccomp profiles on this architecture")
+	}
+	numbers := make(map[string]uint32)
+	for nr, name := range syscallNames {
+		numbers[name] = uint32(nr)
+	}
+	for _, name := range names {
+		nr, ok := numbers[name]
+		if !ok {
+			return nil, errors.New("unknown syscall " + name)
+		}
+		denied = append(denied, nr)
+	}
+	return denied, nil
+}
+
+// seccompInstall denies the syscalls of the architecture arch to the
+// calling thread and to what it executes, the process making one is
+// killed. Without a filter the calling thread needs no_new_privs.
+func seccompInstall(arch uint32, denied []uint32) error {
+	// the denied syscalls jump to the last instruction
+	n := uint8(len(denied))
+	filter := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		bpfJump(syscall.BPF_JEQ, arch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+		bpfJump(syscall.BPF_JGE, x32SyscallBit, n+1, 0),
+	}
+	for i, nr := range denied {
+		filter = append(filter, bpfJump(syscall.BPF_JEQ, nr, n-uint8(i), 0))
+	}
+	filter = append(filter,
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess))
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	_, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp,
+		seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	if e != 0 {
+		return errors.New("seccomp: " + e.Error())
+	}
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+// bpfJump compares the accumulator with k
+func bpfJump(op uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: syscall.BPF_JMP | op | syscall.BPF_K,
+		Jt: jt, Jf: jf, K: k}
+}
+
+// seccompError is the error of a program killed by seccomp
+type seccompError struct {
+	syscall string
+}
+
+func (e *seccompError) Error() string {
+	if e.syscall == "" {
+		return "killed: disallowed syscall"
+	}
+	return "killed: disallowed syscall " + e.syscall
+}
+
+// IsDisallowed reports whether err is about a program killed for a
+// syscall its seccomp profile denies
+func IsDisallowed(err error) bool {
+	var se *seccompError
+	return errors.As(err, &se)
+}
+
+// audit: type=1326 ... comm="prog" ... syscall=41
+var seccompRecordRe = regexp.MustCompile(
+	`type=1326 .*comm="([^"]*)".* syscall=(\d+)`)
+
+// seccompLog reads the kernel log from the time it is opened, the
+// kernel logs there the processes seccomp kills
+type seccompLog struct {
+	fd int
+}
+
+// openSeccompLog returns nil if the kernel log can not be read
+func openSeccompLog() *seccompLog {
+	fd, err := syscall.Open("/dev/kmsg",
+		syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	_, err = syscall.Seek(fd, 0, io.SeekEnd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil
+	}
+	return &seccompLog{fd}
+}
+
+// denied returns the syscall seccomp last killed the program for
+func (l *seccompLog) denied(prog string) (string, bool) {
+	var name string
+	var found bool
+
+	if l == nil {
+		return "", false
+	}
+	// the kernel keeps 15 bytes of the command name
+	comm := filepath.Base(prog)
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(l.fd, buf)
+		if err == syscall.EPIPE {
+			// records were overwritten before they were read
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+		m := seccompRecordRe.FindSubmatch(buf[:n])
+		if m == nil || string(m[1]) != comm {
+			continue
+		}
+		nr, _ := strconv.Atoi(string(m[2]))
+		name, found = syscallNames[nr], true
+		if name == "" {
+			name = "#" + string(m[2])
+		}
+	}
+	return name, found
+}
+
+func (l *seccompLog) Close() {
+	if l != nil {
+		syscall.Close(l.fd)
+	}
+}
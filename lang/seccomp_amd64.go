@@ -0,0 +1,37 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+func init() {
+	// AUDIT_ARCH_X86_64
+	seccompArch = 0xc000003e
+	syscallNames = map[int]string{
+		41:  "socket",
+		53:  "socketpair",
+		101: "ptrace",
+		310: "process_vm_readv",
+		311: "process_vm_writev",
+		165: "mount",
+		166: "umount2",
+		155: "pivot_root",
+		161: "chroot",
+		167: "swapon",
+		168: "swapoff",
+		169: "reboot",
+		246: "kexec_load",
+		320: "kexec_file_load",
+		175: "init_module",
+		313: "finit_module",
+		176: "delete_module",
+		308: "setns",
+		272: "unshare",
+		250: "keyctl",
+		248: "add_key",
+		249: "request_key",
+		163: "acct",
+		164: "settimeofday",
+		304: "open_by_handle_at",
+		298: "perf_event_open",
+		321: "bpf",
+	}
+}
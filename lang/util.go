@@ -4,40 +4,23 @@ package lang
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-func run(name string,
-	args []string,
-	wd string,
-	stdin io.Reader,
-	stdout io.Writer,
-	stderr io.Writer) error {
-	if use_container {
-		return runContainer(name, args, wd, stdin, stdout, stderr)
-	}
-	return runLocal(name, args, wd, stdin, stdout, stderr)
-}
-
-func runTimed(name string,
-	args []string,
-	wd string,
-	stdin io.Reader,
-	stdout io.Writer,
-	stderr io.Writer,
-	timeout time.Duration) error {
-	if use_container {
-		return runContainerTimed(name, args, wd, stdin, stdout, stderr, timeout)
-	}
-	return runLocalTimed(name, args, wd, stdin, stdout, stderr, timeout)
-}
-
 func runLocal(name string,
 	args []string,
 	wd string,
@@ -63,19 +46,145 @@ func runLocal(name string,
 
 func runLocalTimed(name string,
 	args []string,
+	env []string,
 	wd string,
 	stdin io.Reader,
 	stdout io.Writer,
 	stderr io.Writer,
-	timeout time.Duration) error {
-	var err error
+	timeout time.Duration,
+	memory int) error {
 	var cmd *exec.Cmd
 
+	if memory > 0 {
+		// the shell limits the data segment and becomes the command,
+		// the address space is no good for runtimes reserving plenty.
+		// The runner reports the usage of the command, which would
+		// count the memory of the server if it started the shell.
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		args = append([]string{runnerArg, "/bin/sh",
+			"-c", `ulimit -d "$0" && exec "$@"`,
+			strconv.Itoa(memory << 10), name}, args...)
+		name = exe
+	}
 	cmd = exec.Command(name, args...)
+	unprivileged(cmd)
 	cmd.Dir = wd
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
+	if memory <= 0 {
+		return waitTimed(cmd, timeout)
+	}
+
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	cmd.ExtraFiles = []*os.File{wr}
+	err = waitTimed(cmd, timeout)
+	wr.Close()
+	report := readReport(rd)
+	if report == nil {
+		return err
+	}
+	return report.error(err, memory)
+}
+
+// The argument making the server the runner of the command following it
+const runnerArg = "runinit"
+
+// The pipe a runner reports how the command ended on
+const reportFd = 3
+
+// runReport is how the command run by a runner ended
+type runReport struct {
+	// The signal killing the command, 0 if it exited
+	Signal int
+	// The most memory the command used, in kilobytes
+	Maxrss int64
+}
+
+func init() {
+	if len(os.Args) > 2 && os.Args[1] == runnerArg {
+		runtime.LockOSThread()
+		path, err := exec.LookPath(os.Args[2])
+		if err == nil {
+			err = runReported(path, os.Args[2:])
+		}
+		fmt.Fprintln(os.Stderr, "run:", err)
+		os.Exit(127)
+	}
+}
+
+// runReported runs the command at path with the arguments argv in a
+// process of its own, its usage then is not the runner's, and reports
+// how it ended. The runner exits as the command did, or with 128 and
+// the signal killing it.
+func runReported(path string, argv []string) error {
+	// the command can neither read nor write the report
+	syscall.CloseOnExec(reportFd)
+	_, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0)
+	if e != 0 {
+		return errors.New("not dumpable: " + e.Error())
+	}
+
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Args[0] = argv[0]
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// the command goes with the runner when it runs out of time
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	err := cmd.Run()
+	if cmd.ProcessState == nil {
+		return err
+	}
+
+	var report runReport
+	st, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		report.Maxrss = ru.Maxrss
+	}
+	code := st.ExitStatus()
+	if st.Signaled() {
+		report.Signal = int(st.Signal())
+		code = 128 + report.Signal
+	}
+	err = json.NewEncoder(os.NewFile(reportFd, "report")).Encode(&report)
+	if err != nil {
+		return err
+	}
+	os.Exit(code)
+	return nil
+}
+
+// readReport reads the report of the runner once it ended, nil if it
+// made none: the command did not run, or ran out of time
+func readReport(rd io.Reader) *runReport {
+	var report runReport
+
+	if json.NewDecoder(rd).Decode(&report) != nil {
+		return nil
+	}
+	return &report
+}
+
+// error returns the error of the command, given err of its runner
+func (r *runReport) error(err error, memory int) error {
+	if r.Signal != 0 {
+		err = errors.New("signal: " + syscall.Signal(r.Signal).String())
+	}
+	return outOfMemory(err, r.Maxrss, memory)
+}
+
+// waitTimed runs the command, killing it after timeout
+func waitTimed(cmd *exec.Cmd, timeout time.Duration) error {
+	var err error
 
 	start := time.Now()
 	chDone := make(chan bool)
@@ -93,8 +202,7 @@ func runLocalTimed(name string,
 			cmd.Process.Kill()
 			var st *os.ProcessState
 			st, _ = cmd.Process.Wait()
-			err = fmt.Errorf("program killed after %s:%s",
-				t.Sub(start).String(), st)
+			err = &timeoutError{t.Sub(start), st.String()}
 		}
 		break
 	}
@@ -134,11 +242,65 @@ func writeSource(path, code string) error {
 	return err
 }
 
-func setupWorkspace(c Compiler, sourcefile, code string) (string, string, error) {
+// writeFiles places the files of a request under dir, the paths must
+// stay inside of it.
+func writeFiles(dir string, files map[string]string) error {
+	for name, content := range files {
+		if !isLocalPath(name) {
+			return fmt.Errorf("invalid file path %s", name)
+		}
+		fpath := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(fpath), 0775)
+		if err != nil {
+			return err
+		}
+		err = writeSource(fpath, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLocalPath reports whether name is a relative path that does not
+// escape the directory it is resolved in.
+func isLocalPath(name string) bool {
+	if name == "" || filepath.IsAbs(name) {
+		return false
+	}
+	name = filepath.Clean(name)
+	return name != "." && name != ".." &&
+		!strings.HasPrefix(name, "../")
+}
+
+// listFiles returns the sorted names of files with the extension ext,
+// only those in the top directory of the workspace if top is set.
+func listFiles(files map[string]string, ext string, top bool) []string {
+	var names []string
+
+	for name := range files {
+		if filepath.Ext(name) != ext {
+			continue
+		}
+		if top && filepath.Dir(filepath.Clean(name)) != "." {
+			continue
+		}
+		names = append(names, filepath.Clean(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func setupWorkspace(c Compiler, sourcefile, code string,
+	files map[string]string) (string, string, error) {
 	dir, id, err := createWorkspace(c)
 	if err != nil {
 		return "", "", err
 	}
+	err = writeFiles(dir, files)
+	if err != nil {
+		return "", "", err
+	}
 	srcpath := fmt.Sprintf("%s/%s", dir, sourcefile)
 	err = writeSource(srcpath, code)
 	if err != nil {
@@ -157,3 +319,20 @@ func getStringBuffer(buf *bytes.Buffer) string {
 
 	return string(buf.Next(256)) + "..."
 }
+
+func getArtifactBuffer(buf *bytes.Buffer) string {
+	if buf == nil {
+		return ""
+	}
+	if buf.Len() <= MaxArtifactLength {
+		return buf.String()
+	}
+
+	return string(buf.Next(MaxArtifactLength)) + "..."
+}
+
+func unsupportedMode(c Compiler, mode Mode) *Result {
+	return &Result{
+		Error: fmt.Sprintf("%s does not support %s mode", c.Name(), mode),
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 Alex Fluter
+
+package lang
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File describes a file in a workspace
+type File struct {
+	// Path relative to the workspace
+	Name string
+	// Size in bytes
+	Size int64
+	// Last modification time
+	ModTime time.Time
+}
+
+// Workspace returns the directory of the job id run by c.
+func Workspace(c Compiler, id string) string {
+	return fmt.Sprintf("%s/%s%s", DataStore, c.Name(), id)
+}
+
+// ListWorkspace returns the regular files under dir. Symbolic links
+// are neither listed nor followed, so the listing stays in dir.
+func ListWorkspace(dir string) ([]File, error) {
+	var files []File
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{name, fi.Size(), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -15,6 +15,45 @@ type CompileArgs struct {
 
 	// The language of the code
 	Lang string
+
+	// What to produce instead of running the program:
+	// "asm", "preprocess" or "llvm-ir", empty to run it, or "test"
+	// to run the tests in the code
+	Mode string
+
+	// Optimization level of the produced code, such as "-O2"
+	Opt string
+
+	// Use intel syntax for the assembly code
+	Intel bool
+
+	// Extra compiler flags, checked against the server's flag policy
+	Flags []string
+
+	// Other files of the program, keyed by their relative path, such
+	// as headers and other translation units
+	Files map[string]string
+
+	// A tar, tar.gz or zip archive of the program's files, they are
+	// added to Files
+	Archive []byte
+
+	// The file holding the code, when it comes from Files or Archive
+	Entry string
+
+	// A shell command building and running the program, in place of
+	// Code and the language's compiler
+	Build string
+
+	// Keep the workspace instead of letting it be collected
+	Keep bool
+
+	// Benchmarks to run in test mode, a regular expression
+	Bench string
+	// Run the tests with the race detector
+	Race bool
+	// Report the coverage of the tests
+	Cover bool
 }
 
 type CompileReply struct {
@@ -34,15 +73,54 @@ type CompileReply struct {
 	P_Output string
 	// The program's standard output, if compiled successfully and run
 	P_Error string
+	// The assembly, preprocessed source or IR produced in place of
+	// running the program
+	Artifact string
+	// Whether the program came from the build cache
+	Cached bool
+	// Outcome of each test, in test mode
+	Tests []lang.TestResult
+	// The errors and warnings of the compiler
+	Diagnostics []lang.Diagnostic
+	// The sandbox the code ran in: "container", "namespaces" or "host"
+	Isolation string
 }
 
 type Compiler struct {
 	Name    string
 	Version string
+	// The sandbox the compiler runs the code in
+	Isolation string
 }
 
 type ListReply struct {
 	Compilers []Compiler
+	// The sandbox of the compilers not configured otherwise
+	Isolation string
+}
+
+type FilesArgs struct {
+	// The compiling ID whose workspace is listed
+	Id string
+}
+
+type FilesReply struct {
+	Files []lang.File
+}
+
+type FetchArgs struct {
+	// The compiling ID whose workspace holds the file
+	Id string
+	// Path of the file in the workspace
+	Name string
+}
+
+type FetchReply struct {
+	Data []byte
+}
+
+type StatsReply struct {
+	Usage
 }
 
 // RPC service
@@ -74,6 +152,41 @@ func (c *CompileService) Compile(args *CompileArgs, reply *CompileReply) error {
 	reply.C_Error = res.C_Error
 	reply.P_Output = res.P_Output
 	reply.P_Error = res.P_Error
+	reply.Artifact = res.Artifact
+	reply.Cached = res.Cached
+	reply.Tests = res.Tests
+	reply.Diagnostics = res.Diagnostics
+	reply.Isolation = req.isolation
+	reply.Time = time.Now().Sub(req.received)
+
+	close(req.chRes)
+	return nil
+}
+
+// Build the code once and run it against each test case
+func (c *CompileService) Judge(args *JudgeArgs, reply *JudgeReply) error {
+	req := &Request{
+		received: time.Now(),
+		args:     &args.CompileArgs,
+		chRes:    make(chan *lang.Result),
+		cases:    args.Cases,
+	}
+	if req.cases == nil {
+		req.cases = []TestCase{}
+	}
+
+	c.server.Submit(req)
+
+	res := <-req.chRes
+
+	reply.Id = res.Id
+	reply.Cmd = res.Cmd
+	reply.Error = res.Error
+	reply.C_Output = res.C_Output
+	reply.C_Error = res.C_Error
+	reply.Diagnostics = res.Diagnostics
+	reply.Cases = req.results
+	reply.Isolation = req.isolation
 	reply.Time = time.Now().Sub(req.received)
 
 	close(req.chRes)
@@ -83,8 +196,36 @@ func (c *CompileService) Compile(args *CompileArgs, reply *CompileReply) error {
 func (c *CompileService) List(args struct{}, reply *ListReply) error {
 	for _, cname := range c.server.ListCompiler() {
 		c := c.server.GetCompiler(cname)
-		reply.Compilers = append(reply.Compilers, Compiler{c.Name(), c.Version()})
+		reply.Compilers = append(reply.Compilers,
+			Compiler{c.Name(), c.Version(), isolation(c)})
+	}
+	reply.Isolation = c.server.sandbox.Name()
+	return nil
+}
+
+// List the files produced in the workspace of a compiling request
+func (c *CompileService) Files(args *FilesArgs, reply *FilesReply) error {
+	var err error
+
+	reply.Files, err = c.server.ListFiles(args.Id)
+	return err
+}
+
+// Fetch a file from the workspace of a compiling request
+func (c *CompileService) Fetch(args *FetchArgs, reply *FetchReply) error {
+	var err error
+
+	reply.Data, err = c.server.ReadFile(args.Id, args.Name)
+	return err
+}
+
+// Report the disk usage of the workspaces
+func (c *CompileService) Stats(args struct{}, reply *StatsReply) error {
+	u, err := c.server.Usage()
+	if err != nil {
+		return err
 	}
+	reply.Usage = *u
 	return nil
 }
 
@@ -110,6 +251,13 @@ func (c *CompileServiceStub) Compile(args *CompileArgs, reply *CompileReply) err
 	return err
 }
 
+func (c *CompileServiceStub) Judge(args *JudgeArgs, reply *JudgeReply) error {
+	var err error
+
+	err = c.client.Call("CompileService.Judge", args, reply)
+	return err
+}
+
 func (c *CompileServiceStub) List(args struct{}, reply *ListReply) error {
 	var err error
 
@@ -117,6 +265,27 @@ func (c *CompileServiceStub) List(args struct{}, reply *ListReply) error {
 	return err
 }
 
+func (c *CompileServiceStub) Files(args *FilesArgs, reply *FilesReply) error {
+	var err error
+
+	err = c.client.Call("CompileService.Files", args, reply)
+	return err
+}
+
+func (c *CompileServiceStub) Fetch(args *FetchArgs, reply *FetchReply) error {
+	var err error
+
+	err = c.client.Call("CompileService.Fetch", args, reply)
+	return err
+}
+
+func (c *CompileServiceStub) Stats(args struct{}, reply *StatsReply) error {
+	var err error
+
+	err = c.client.Call("CompileService.Stats", args, reply)
+	return err
+}
+
 func (c *CompileServiceStub) Close() error {
 	return c.client.Close()
 }
@@ -1,15 +1,29 @@
 package lotsawa
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/fluter01/lotsawa/lang"
 )
 
 const addr = "127.0.0.1:1234"
 
 func (r *CompileReply) String() string {
-	return fmt.Sprintf("ID: %s\nCmd: %s\nTook:%s\nError:%s\nCompile:%s|%s\nRun:%s|%s\n",
+	return fmt.Sprintf("ID: %s\nCmd: %s\nTook:%s\nError:%s\nCompile:%s|%s\nRun:%s|%s\nArtifact:%s\n",
 		r.Id,
 		r.Cmd,
 		r.Time,
@@ -17,26 +31,27 @@ func (r *CompileReply) String() string {
 		r.C_Output,
 		r.C_Error,
 		r.P_Output,
-		r.P_Error)
+		r.P_Error,
+		r.Artifact)
 }
 
 var testData []CompileArgs = []CompileArgs{
-	{`abc`, "c"},
-	{`
+	{Code: `abc`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int main(void) {
 		puts("hello");
 		printf("%d\n", __STDC_NO_THREADS__);
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int foo(void) {
 		puts("foo");
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int foo(void) {
 		puts("foo");
@@ -45,24 +60,24 @@ var testData []CompileArgs = []CompileArgs{
 		foo();
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int main(void) {
 		fprintf(stdout, "output to stdout\n");
 		fprintf(stderr, "output to stderr\n");
 		return 0;
 	}
-	`, "c"},
-	{`#include <stdio.h>
+	`, Lang: "c"},
+	{Code: `#include <stdio.h>
 	int main(int argc, char *argv[]) {
 		int *p = 3;
 		fprintf(stdout, "output to stdout\n");
 		fprintf(stderr, "output to stderr\n");
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int main(int argc, char *argv[]) {
 		int *p = 3;
@@ -71,8 +86,8 @@ var testData []CompileArgs = []CompileArgs{
 		fprintf(stderr, "output to stderr\n");
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int main(int argc, char *argv[]) {
 		while (1) {
@@ -81,8 +96,8 @@ var testData []CompileArgs = []CompileArgs{
 		}
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	#include <stdio.h>
 	int main(int argc, char *argv[]) {
 		FILE *fp = fopen("foo.txt", "w");
@@ -91,50 +106,158 @@ var testData []CompileArgs = []CompileArgs{
 		fclose(fp);
 		return 0;
 	}
-	`, "c"},
-	{`
+	`, Lang: "c"},
+	{Code: `
 	pwd
 	uname -a
-	`, "sh"},
-	{`
+	`, Lang: "sh"},
+	{Code: `
 		fmt.Println("hello lotsawa go");
-	`, "go"},
-	{`
+	`, Lang: "go"},
+	{Code: `
 		var i int
 		var j int
 		i = 3
 		j = i + 5
 		fmt.Println("i =", i, "j =", j)
-	`, "go"},
-	{`package main
+	`, Lang: "go"},
+	{Code: `package main
 import "fmt"
 func main() {
 	foo()
 }
 func foo() {
 	fmt.Println("in foo")
-}`, "go"},
-	{`panic("foo")`, "go"},
-	{`i = 3`, "go"},
-	{`i := 3`, "go"},
-	{`type S struct {
+}`, Lang: "go"},
+	{Code: `panic("foo")`, Lang: "go"},
+	{Code: `i = 3`, Lang: "go"},
+	{Code: `i := 3`, Lang: "go"},
+	{Code: `type S struct {
 	a int
 	}
 
 	func main() {
 	s := S{3}
 	fmt.Println(s.a)
-	}`, "go"},
-	{`s := "hello"
-	fmt.Println(s)`, "go"}, // frag
-	{`func main() {
+	}`, Lang: "go"},
+	{Code: `s := "hello"
+	fmt.Println(s)`, Lang: "go"}, // frag
+	{Code: `func main() {
 	fmt.Println("Hello")
-}`, "go"}, // func
-	{`package main
+}`, Lang: "go"}, // func
+	{Code: `package main
 	func main() {
 		fmt.Println("Hello")
-	}`, "go"}, // package
-	{`s := "hello"`, "go"}, // frag
+	}`, Lang: "go"}, // package
+	{Code: `s := "hello"`, Lang: "go"}, // frag
+	{Code: `public class Hello {
+	public static void main(String[] args) {
+		System.out.println("hello java");
+	}
+}`, Lang: "java"},
+	{Code: `class Point {
+	int x, y;
+}
+
+public class Shapes {
+	static public void main(String... args) {
+		System.out.println(new Point().x);
+	}
+}`, Lang: "java"},
+	{Code: `class Util {
+	static int twice(int x) { return 2 * x; }
+}`, Lang: "java"}, // no main
+	{Code: `fun main() {
+	println("hello kotlin")
+}`, Lang: "kotlin"},
+	{Code: `let x = 3
+	x + 4
+	function twice(a) {
+		return a * 2
+	}
+	twice(x)
+	console.log("hello node")`, Lang: "js"},
+	{Code: `undefinedFunction()`, Lang: "js"},
+	{Code: `const n: number = 6
+	n * 7`, Lang: "ts"},
+	{Code: `	.globl _start
+	.text
+_start:
+	mov $1, %rax
+	mov $1, %rdi
+	lea msg(%rip), %rsi
+	mov $6, %rdx
+	syscall
+	mov $60, %rax
+	xor %rdi, %rdi
+	syscall
+msg:
+	.ascii "hello\n"`, Lang: "asm"},
+	{Code: `	.globl main
+	.text
+main:
+	sub $8, %rsp
+	lea msg(%rip), %rdi
+	call puts
+	xor %eax, %eax
+	add $8, %rsp
+	ret
+msg:
+	.asciz "hello libc"`, Lang: "gas-libc"},
+	{Code: `	.text
+add:
+	lea (%rdi,%rsi), %rax
+	ret`, Lang: "asm"}, // no entry
+	{Code: `my $s = "hello perl";
+	print "$s\n";`, Lang: "perl"},
+}
+
+// fakePlugin is the compiler of the plugin the test binary becomes when
+// it is started as one
+type fakePlugin struct{}
+
+func (f *fakePlugin) Name() string    { return "Fake" }
+func (f *fakePlugin) Version() string { return "1.0" }
+func (f *fakePlugin) Init() error     { return nil }
+
+func (f *fakePlugin) Compile(req *lang.Args) *lang.Result {
+	var stdout, stderr bytes.Buffer
+
+	res := f.CompileStream(req, &stdout, &stderr)
+	res.P_Output, res.P_Error = stdout.String(), stderr.String()
+	return res
+}
+
+func (f *fakePlugin) CompileStream(req *lang.Args,
+	stdout, stderr io.Writer) *lang.Result {
+	switch req.Code {
+	case "pid":
+		fmt.Fprint(stdout, os.Getpid())
+	case "args":
+		fmt.Fprint(stdout, req.Mode, req.Opt, req.Intel)
+	case "crash":
+		os.Exit(2)
+	case "freeze":
+		// stop answering once the reply is sent
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+		}()
+	default:
+		for _, line := range strings.SplitAfter(req.Code, "\n") {
+			fmt.Fprint(stdout, line)
+			time.Sleep(300 * time.Millisecond)
+		}
+	}
+	return &lang.Result{Cmd: "fake"}
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("LOTSAWA_TEST_PLUGIN") != "" {
+		lang.ServePlugin(new(fakePlugin), lang.StdioConn())
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
 }
 
 func startServer(t *testing.T, exit chan bool) *Server {
@@ -191,6 +314,188 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestDefinitions(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	defs := map[string]string{
+		"broken.json": `{"name": "Broken",`,
+		"shadow.yaml": "name: Shadow\naliases: [C]\nsource: prog.c\n" +
+			"run: [cat, $SRC]\n",
+	}
+	for name, def := range defs {
+		path := filepath.Join(lang.LanguageDir, name)
+		err = ioutil.WriteFile(path, []byte(def), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+	}
+
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var res ListReply
+	err = c.List(struct{}{}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, comp := range res.Compilers {
+		names[comp.Name] = true
+	}
+	if !names["Lua"] || !names["Perl"] {
+		t.Error("yaml and json definitions not loaded")
+	}
+	if names["Shadow"] {
+		t.Error("definition replaced a compiler")
+	}
+	if _, ok := s.compSvr.GetCompiler("C").(*lang.C11); !ok {
+		t.Error("C is not the built-in compiler")
+	}
+}
+
+// installPlugin makes the test binary the plugin "fake", it is removed
+// by calling the returned function
+func installPlugin(t *testing.T) func() {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(lang.PluginDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\nLOTSAWA_TEST_PLUGIN=1 exec " + exe + "\n"
+	err = ioutil.WriteFile(filepath.Join(lang.PluginDir, "fake"),
+		[]byte(script), 0755)
+	if err != nil {
+		os.RemoveAll(lang.PluginDir)
+		t.Fatal(err)
+	}
+	return func() { os.RemoveAll(lang.PluginDir) }
+}
+
+func TestPlugin(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	defer installPlugin(t)()
+
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var list ListReply
+	err = c.List(struct{}{}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, comp := range list.Compilers {
+		found = found || comp.Name == "Fake" && comp.Version == "1.0"
+	}
+	if !found {
+		t.Fatal("plugin not registered after the handshake")
+	}
+
+	compile := func(code string) CompileReply {
+		var res CompileReply
+		err := c.Compile(&CompileArgs{Code: code, Lang: "fake"}, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res)
+		return res
+	}
+	// waits for the plugin to answer from another process than pid
+	restarted := func(pid string, within time.Duration) string {
+		for start := time.Now(); time.Since(start) < within; {
+			res := compile("pid")
+			if res.Error == "" && res.P_Output != pid {
+				return res.P_Output
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		t.Fatal("plugin not restarted")
+		return ""
+	}
+
+	res := compile("one\ntwo\n")
+	if res.Error != "" || res.P_Output != "one\ntwo\n" || res.Cmd != "fake" {
+		t.Error("output not streamed back")
+	}
+
+	var ares CompileReply
+	err = c.Compile(&CompileArgs{Code: "args", Lang: "fake", Mode: "asm",
+		Opt: "-O2", Intel: true}, &ares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ares.P_Output != "asm-O2true" {
+		t.Errorf("plugin got %q", ares.P_Output)
+	}
+	ares = CompileReply{}
+	err = c.Compile(&CompileArgs{Code: "args", Lang: "fake",
+		Files: map[string]string{"a.h": ""}}, &ares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ares.Error, "protocol version 1") {
+		t.Errorf("files passed to the plugin: %q", ares.Error)
+	}
+
+	// the plugin runs the code as it compiles it, once
+	var jres JudgeReply
+	err = c.Judge(&JudgeArgs{CompileArgs: CompileArgs{Code: "args",
+		Lang: "fake"}, Cases: []TestCase{{}}}, &jres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(jres.Error, "can not be judged") ||
+		len(jres.Cases) != 0 {
+		t.Errorf("plugin judged: %q %v", jres.Error, jres.Cases)
+	}
+
+	pid := restarted("", 5*time.Second)
+	// a compilation may take longer than a call, the plugin is kept
+	long := strings.Repeat(".\n", (lang.RunTimeout+lang.PluginTimeout)*4)
+	res = compile(long)
+	if res.Error != "" || res.P_Output != long {
+		t.Errorf("long compilation cut: %q", res.Error)
+	}
+	if res = compile("pid"); res.P_Output != pid {
+		t.Error("plugin restarted after a long compilation")
+	}
+	res = compile("crash")
+	if res.Error == "" {
+		t.Error("crash not reported")
+	}
+	pid = restarted(pid, 5*time.Second)
+
+	res = compile("freeze")
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	// the health check finds it frozen and restarts it
+	time.Sleep((lang.PluginInterval + lang.PluginTimeout + 1) * time.Second)
+	res = compile("pid")
+	if res.Error != "" || res.P_Output == pid {
+		t.Error("frozen plugin not restarted by the health check")
+	}
+}
+
 func TestGo(t *testing.T) {
 	var err error
 	var exit chan bool = make(chan bool)
@@ -203,13 +508,13 @@ func TestGo(t *testing.T) {
 	c := getClient(t)
 	defer c.Close()
 
-	arg := CompileArgs{`
+	arg := CompileArgs{Code: `
 		var i int
 		var j int
 		i = 3
 		j = i + 5
 		fmt.Println("i =", i, "j =", j)
-	`, "go"}
+	`, Lang: "go"}
 	var res CompileReply
 	err = c.Compile(&arg, &res)
 
@@ -219,6 +524,136 @@ func TestGo(t *testing.T) {
 	t.Log(&res)
 }
 
+func TestJava(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	if _, err = exec.LookPath("javac"); err != nil {
+		t.Skip("no java compiler")
+	}
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	arg := CompileArgs{Code: `// the main class Foo is below
+public class Hello {
+	/* class Bar { */
+	static class Greeter {
+		String greet() { return "class Baz"; }
+	}
+
+	public static void main(String[] args) {
+		System.out.println(new Greeter().greet());
+	}
+}`, Lang: "java"}
+	var res CompileReply
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error != "" || res.P_Output != "class Baz\n" {
+		t.Error("main class not detected")
+	}
+}
+
+func TestNode(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	if _, err = exec.LookPath("node"); err != nil {
+		t.Skip("no node")
+	}
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	arg := CompileArgs{Code: `let x = 3
+x + 4
+if (x > 2) {
+	console.log("big")
+}
+else {
+	console.log("small")
+}
+twice(x)
+function twice(a) {
+	return a * 2
+}
+const o = {
+	a: 1,
+}
+o.a
+"done"`, Lang: "js"}
+	var res CompileReply
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error != "" || res.P_Output != "7\nbig\n6\n1\n'done'\n" {
+		t.Errorf("unexpected output %q", res.P_Output)
+	}
+
+	res = CompileReply{}
+	err = c.Compile(&CompileArgs{Code: "let y = (\n", Lang: "js"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error == "" || !strings.Contains(res.P_Error, "SyntaxError") {
+		t.Error("syntax error not reported")
+	}
+}
+
+func TestAsm(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	// the hello programs of testData, linked by ld and by gcc
+	cases := []struct {
+		arg    CompileArgs
+		linker string
+	}{
+		{testData[28], "ld "},
+		{testData[29], "gcc "},
+	}
+	for _, tc := range cases {
+		var res CompileReply
+		err = c.Compile(&tc.arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res)
+		if res.Error != "" || !strings.HasPrefix(res.P_Output, "hello") {
+			t.Errorf("%s: unexpected output %q", tc.arg.Lang, res.P_Output)
+		}
+		cmds := strings.Split(res.Cmd, "; ")
+		if len(cmds) != 2 || !strings.HasPrefix(cmds[0], "as ") ||
+			!strings.HasPrefix(cmds[1], tc.linker) {
+			t.Errorf("%s: unexpected command %q", tc.arg.Lang, res.Cmd)
+		}
+	}
+}
+
 func TestCompile(t *testing.T) {
 	var err error
 	var exit chan bool = make(chan bool)
@@ -243,6 +678,1308 @@ func TestCompile(t *testing.T) {
 	}
 }
 
+func TestMode(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	args := []CompileArgs{
+		{Code: `int square(int x) { return x * x; }`,
+			Lang: "c", Mode: "asm", Opt: "-O2", Intel: true},
+		{Code: `#define SQUARE(x) ((x) * (x))
+	int square(int x) { return SQUARE(x); }`,
+			Lang: "c", Mode: "preprocess"},
+		{Code: `package main
+	func square(x int) int { return x * x }
+	func main() { println(square(3)) }`,
+			Lang: "go", Mode: "asm"},
+	}
+	for _, arg := range args {
+		var res CompileReply
+		err = c.Compile(&arg, &res)
+
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(&res)
+		if res.Error != "" || !strings.Contains(res.Artifact, "square") {
+			t.Errorf("%s %s: no artifact", arg.Lang, arg.Mode)
+		}
+	}
+
+	var res CompileReply
+	arg := CompileArgs{Code: `int main(void) { return 0; }`,
+		Lang: "c", Mode: "llvm-ir"}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.Error == "" {
+		t.Error("gcc should not produce LLVM IR")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var res CompileReply
+	arg := CompileArgs{Code: `int main(void) { puts(GREETING); return 0; }`,
+		Lang:  "c",
+		Flags: []string{"-O2", "-DGREETING=\"hi\"", "-Wno-shadow"}}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Error(err)
+	}
+	t.Log(&res)
+	if res.Error != "" || res.P_Output != "hi\n" ||
+		!strings.Contains(res.Cmd, "-DGREETING") {
+		t.Error("flags not applied")
+	}
+
+	for _, flag := range []string{"-o/tmp/prog", "-B/tmp", "-specs=x",
+		"@args", "-fplugin=x.so", "-Wl,-T,x", "-I/etc",
+		"-fsanitize-blacklist=/etc/passwd",
+		"-fsanitize-ignorelist=/etc/passwd",
+		"-fsanitize=address,/etc/passwd"} {
+		res = CompileReply{}
+		arg = CompileArgs{Code: `int main(void) { return 0; }`,
+			Lang: "c", Flags: []string{flag}}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Error(err)
+		}
+		if res.Error == "" {
+			t.Errorf("flag %s accepted", flag)
+		}
+	}
+
+	res = CompileReply{}
+	arg = CompileArgs{Code: `int main(void) { return 0; }`, Lang: "c",
+		Flags: []string{"-fsanitize=undefined", "-fno-sanitize-recover"}}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.Error != "" {
+		t.Error("sanitizer flags refused:", res.Error)
+	}
+
+	for _, lang := range []string{"go", "sh", "js"} {
+		res = CompileReply{}
+		arg = CompileArgs{Code: "x", Lang: lang, Flags: []string{"-O2"}}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(res.Error, "does not take flags") {
+			t.Errorf("flags given to %s: %q", lang, res.Error)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	files := map[string]string{
+		"square.h": `int square(int x);
+`,
+		"square.c": `#include "square.h"
+int square(int x) { return x * x; }
+`,
+		"test/driver.c": `#include <stdio.h>
+#include "../square.h"
+int main(void) { printf("%d\n", square(7)); return 0; }
+`,
+	}
+	args := []CompileArgs{
+		{Lang: "c", Files: files},
+		{Code: `#include "square.h"
+	int cube(int x) { return x * square(x); }`, Lang: "c", Files: files},
+		{Code: `package main
+	func main() { println(twice(21)) }`, Lang: "go", Files: map[string]string{
+			"twice.go": "package main\nfunc twice(x int) int { return 2 * x }\n",
+		}},
+	}
+	for _, arg := range args {
+		var res CompileReply
+		err = c.Compile(&arg, &res)
+
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(&res)
+		if res.Error != "" {
+			t.Errorf("%s: %s", arg.Lang, res.Error)
+		}
+	}
+
+	var res CompileReply
+	arg := CompileArgs{Code: `int main(void) { return 0; }`, Lang: "c",
+		Files: map[string]string{"../escape.h": ""}}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.Error == "" {
+		t.Error("path outside of the workspace accepted")
+	}
+}
+
+func makeTarGz(t *testing.T, files map[string]string, link string) []byte {
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if link != "" {
+		hdr := &tar.Header{Name: link, Typeflag: tar.TypeSymlink,
+			Linkname: "/etc/passwd"}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	files := map[string]string{
+		"./square.h": "int square(int x);\n",
+		"./square.c": "#include \"square.h\"\nint square(int x) { return x * x; }\n",
+		"./main.c":   "#include \"square.h\"\nint main(void) { printf(\"%d\\n\", square(5)); }\n",
+	}
+	args := []CompileArgs{
+		{Lang: "c", Archive: makeTarGz(t, files, ""), Entry: "main.c"},
+		{Archive: makeZip(t, files), Build: "gcc -o app *.c && ./app"},
+	}
+	for _, arg := range args {
+		var res CompileReply
+		err = c.Compile(&arg, &res)
+
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(&res)
+		if res.Error != "" || res.P_Output != "25\n" {
+			t.Errorf("archive not built: %s", res.Error)
+		}
+	}
+
+	// the entry includes the headers next to it
+	nested := map[string]string{
+		"src/util.h": "int twice(int x);\n",
+		"src/util.c": "#include \"util.h\"\nint twice(int x) { return 2 * x; }\n",
+		"src/main.c": "#include <stdio.h>\n#include \"util.h\"\n" +
+			"int main(void) { printf(\"%d\\n\", twice(4)); }\n",
+	}
+	// the build runs longer than the programs may
+	slow := CompileArgs{Archive: makeZip(t, files),
+		Build: "sleep 4 && gcc -o app *.c && ./app"}
+	for want, arg := range map[string]CompileArgs{
+		"8\n": {Lang: "c", Archive: makeTarGz(t, nested, ""),
+			Entry: "src/main.c"},
+		"25\n": slow,
+	} {
+		var res CompileReply
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(&res)
+		if res.Error != "" || res.P_Output != want {
+			t.Errorf("archive not built: %s", res.Error)
+		}
+	}
+
+	bad := []CompileArgs{
+		{Lang: "c", Archive: makeTarGz(t, files, "passwd"), Entry: "main.c"},
+		{Lang: "c", Archive: makeZip(t, map[string]string{"../x.c": ""})},
+		{Lang: "c", Archive: []byte("garbage")},
+	}
+	for _, arg := range bad {
+		var res CompileReply
+		err = c.Compile(&arg, &res)
+
+		if err != nil {
+			t.Error(err)
+		}
+		t.Log(&res)
+		if res.Error == "" {
+			t.Error("bad archive accepted")
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var res CompileReply
+	arg := CompileArgs{Code: `int main(void) {
+		FILE *fp = fopen("out/plot.txt", "w");
+		fputs("plotted\n", fp);
+		fclose(fp);
+		symlink("/etc/passwd", "passwd");
+		return 0;
+	}`, Lang: "c", Files: map[string]string{"out/.keep": ""}}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+
+	var files FilesReply
+	err = c.Files(&FilesArgs{Id: res.Id}, &files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(files)
+	for _, f := range files.Files {
+		if f.Name == "passwd" {
+			t.Error("symbolic link listed")
+		}
+	}
+
+	var data FetchReply
+	err = c.Fetch(&FetchArgs{Id: res.Id, Name: "out/plot.txt"}, &data)
+	if err != nil || string(data.Data) != "plotted\n" {
+		t.Error("fetch failed:", err)
+	}
+
+	for _, name := range []string{"passwd", "../../rpc.go", "missing"} {
+		err = c.Fetch(&FetchArgs{Id: res.Id, Name: name}, &data)
+		if err == nil {
+			t.Errorf("fetched %s", name)
+		}
+	}
+	err = c.Files(&FilesArgs{Id: "../" + res.Id}, &files)
+	if err == nil {
+		t.Error("invalid id accepted")
+	}
+}
+
+func TestJudge(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	arg := JudgeArgs{CompileArgs: CompileArgs{Code: `int main(int argc, char *argv[]) {
+		int a, b;
+		if (argc > 1 && strcmp(argv[1], "loop") == 0)
+			while (1);
+		if (argc > 1 && strcmp(argv[1], "kill") == 0)
+			raise(SIGKILL);
+		for (int i = 0; argc > 2 && i < atoi(argv[2]); i++) {
+			char *p = malloc(1 << 20);
+			if (p == NULL)
+				abort();
+			memset(p, 1, 1 << 20);
+		}
+		if (scanf("%d %d", &a, &b) != 2)
+			return 1;
+		printf("%d\n%f\n", a + b, a / 3.0);
+		return 0;
+	}`, Lang: "c"}, Cases: []TestCase{
+		{Stdin: "1 2", Expected: "3\n0.333333\n"},
+		{Stdin: "1 2", Expected: "3 0.33333"},
+		{Stdin: "1 2", Expected: "3 0.3333", Compare: CompareFloat, Tolerance: 1e-3},
+		{Stdin: "1 2", Expected: "3  0.333333", Compare: CompareWhitespace},
+		{Stdin: "4 2", Expected: "^6\n1\\.3", Compare: CompareRegex},
+		{Stdin: "4 2", Expected: "5\n1.333333\n"},
+		{Stdin: "", Expected: ""},
+		{Stdin: "1 2", Args: []string{"loop"}},
+		{Stdin: "1 2", Args: []string{"kill"}},
+		{Stdin: "1 2", Args: []string{"alloc", "64"}, Expected: "3\n0.333333\n"},
+		{Stdin: "1 2", Args: []string{"alloc", "64"}, Memory: 32},
+		{Stdin: "1 2", Args: []string{"alloc", "1024"}},
+	}}
+	verdicts := []string{Accepted, WrongAnswer, Accepted, Accepted,
+		Accepted, WrongAnswer, RuntimeError, TimeLimitExceeded,
+		RuntimeError, Accepted, MemoryLimitExceeded, MemoryLimitExceeded}
+
+	// the memory used by the server is not the program's on the host
+	// either
+	host, err := lang.NewSandbox(lang.SandboxHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res JudgeReply
+	for _, sb := range []lang.Sandbox{nil, host} {
+		if sb != nil {
+			s.compSvr.GetCompiler("c").(lang.Sandboxed).SetSandbox(sb)
+		}
+		res = JudgeReply{}
+		err = c.Judge(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Error != "" || len(res.Cases) != len(verdicts) {
+			t.Fatal("judge failed:", res.Error, res.C_Error)
+		}
+		for i, r := range res.Cases {
+			t.Log(res.Isolation, i, r)
+			if r.Verdict != verdicts[i] {
+				t.Errorf("%s case %d: expected %s, got %s", res.Isolation,
+					i, verdicts[i], r.Verdict)
+			}
+		}
+	}
+
+	arg = JudgeArgs{CompileArgs: CompileArgs{Code: "read x; echo $((x * $1))", Lang: "sh"},
+		Cases: []TestCase{{Stdin: "3", Args: []string{"7"}, Expected: "21\n"}}}
+	err = c.Judge(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Cases) != 1 || res.Cases[0].Verdict != Accepted {
+		t.Error("script judge failed:", res.Error, res.Cases)
+	}
+
+	// interpreted and defined languages are built once too
+	scripts := []CompileArgs{
+		{Code: "require('fs').readFileSync(0, 'utf8').split(' ')" +
+			".forEach(x => console.log(x * process.argv[3]))", Lang: "js"},
+		{Code: "print join(' ', map { $_ * $ARGV[0] } split ' ', <STDIN>), \"\\n\";",
+			Lang: "perl"},
+	}
+	for _, script := range scripts {
+		arg = JudgeArgs{CompileArgs: script, Cases: []TestCase{
+			{Stdin: "1 2", Args: []string{"3"}, Expected: "3 6",
+				Compare: CompareWhitespace},
+			{Stdin: "1 2", Args: []string{"4"}, Expected: "3 6",
+				Compare: CompareWhitespace},
+		}}
+		res = JudgeReply{}
+		err = c.Judge(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Cases) != 2 || res.Cases[0].Verdict != Accepted ||
+			res.Cases[1].Verdict != WrongAnswer {
+			t.Errorf("%s judge failed: %s %v", script.Lang, res.Error,
+				res.Cases)
+		}
+	}
+
+	arg = JudgeArgs{CompileArgs: CompileArgs{Code: "int main(void) { return x; }", Lang: "c"},
+		Cases: []TestCase{{}}}
+	res = JudgeReply{}
+	err = c.Judge(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" || len(res.Cases) != 0 {
+		t.Error("judged a program that does not build")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	// a fresh snippet each run, so the first build misses, the C one
+	// warns about comparing floats
+	now := time.Now().UnixNano()
+	args := []CompileArgs{
+		{Code: fmt.Sprintf(`int main(void) { printf("%d\n"); return 1.0 == 2.0; }`, now),
+			Lang: "c"},
+		{Code: fmt.Sprintf(`package main
+		func main() { println(%d) }`, now), Lang: "go"},
+	}
+	for _, arg := range args {
+		var res1, res2 CompileReply
+		err = c.Compile(&arg, &res1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Compile(&arg, &res2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res1, &res2)
+		if res1.Cached || !res2.Cached {
+			t.Errorf("%s: expected a miss then a hit, got %v %v",
+				arg.Lang, res1.Cached, res2.Cached)
+		}
+		if res1.Id == res2.Id || res1.P_Output != res2.P_Output ||
+			res1.P_Error != res2.P_Error {
+			t.Errorf("%s: cached program differs", arg.Lang)
+		}
+		if res1.C_Error != res2.C_Error ||
+			fmt.Sprint(res1.Diagnostics) != fmt.Sprint(res2.Diagnostics) {
+			t.Errorf("%s: cached diagnostics differ: %v %v", arg.Lang,
+				res1.Diagnostics, res2.Diagnostics)
+		}
+		if arg.Lang == "c" && len(res2.Diagnostics) == 0 {
+			t.Error("c: the cache hit lost the warning")
+		}
+	}
+
+	arg := args[0]
+	arg.Flags = []string{"-DCHANGED"}
+	var res CompileReply
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Cached {
+		t.Error("cache hit with different flags")
+	}
+}
+
+// makeModule lays out a module in the local Go module proxy
+func makeModule(t *testing.T, path, version string, files map[string]string) {
+	dir := filepath.Join(lang.GoProxyDir, path, "@v")
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := "module " + path + "\n"
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	files["go.mod"] = mod
+	for name, content := range files {
+		f, err := w.Create(path + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	w.Close()
+
+	for name, content := range map[string]string{
+		"list":            version + "\n",
+		version + ".info": `{"Version":"` + version + `"}`,
+		version + ".mod":  mod,
+		version + ".zip":  buf.String(),
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGoProxy(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	makeModule(t, "example.com/greet", "v1.0.0", map[string]string{
+		"greet.go": "package greet\n\nfunc Hello() string { return \"hello proxy\" }\n",
+	})
+	defer os.RemoveAll(lang.GoProxyDir)
+
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var res CompileReply
+	arg := CompileArgs{Lang: "go", Files: map[string]string{
+		"go.mod":  "module prog\n\nrequire example.com/greet v1.0.0\n",
+		"main.go": "package main\n\nimport \"example.com/greet\"\n\nfunc main() { println(greet.Hello()) }\n",
+	}}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.P_Error != "hello proxy\n" {
+		t.Error("module not resolved from the proxy:", res.Error, res.C_Error)
+	}
+
+	// the import and the go.mod are generated for approved modules
+	args := []CompileArgs{
+		{Code: "package main\n\nfunc main() { println(greet.Hello()) }\n",
+			Lang: "go"},
+		{Lang: "go", Files: map[string]string{
+			"main.go": "package main\n\nimport \"example.com/greet\"\n\nfunc main() { println(greet.Hello()) }\n",
+		}},
+	}
+	for _, arg := range args {
+		res = CompileReply{}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res)
+		if res.P_Error != "hello proxy\n" {
+			t.Error("approved module not resolved:", res.Error, res.C_Error)
+		}
+	}
+
+	arg.Files["go.mod"] = "module prog\n\nrequire example.com/missing v1.0.0\n"
+	arg.Files["main.go"] = "package main\n\nimport \"example.com/missing\"\n\nfunc main() { missing.Go() }\n"
+	res = CompileReply{}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" {
+		t.Error("module fetched from outside the proxy")
+	}
+}
+
+func TestGoTest(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var res CompileReply
+	arg := CompileArgs{Code: `import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAdd(t *testing.T) {
+	for _, tc := range []struct{ a, b, sum int }{{1, 2, 3}, {2, 2, 4}} {
+		t.Run(fmt.Sprint(tc.a, tc.b), func(t *testing.T) {
+			if tc.a+tc.b != tc.sum {
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestWrong(t *testing.T) { t.Error("wrong") }
+
+func TestLater(t *testing.T) { t.Skip() }
+
+func BenchmarkLoop(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+	}
+}
+
+func BenchmarkSprint(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		fmt.Sprint(i)
+	}
+}
+
+func BenchmarkSleep(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Example() {
+	fmt.Println("example")
+	// Output: example
+}`, Lang: "go", Mode: "test", Bench: ".", Cover: true}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res, res.Tests)
+
+	outcomes := map[string]string{
+		"TestAdd":     "pass",
+		"TestAdd/1_2": "pass",
+		"TestAdd/2_2": "pass",
+		"TestWrong":   "fail",
+		"TestLater":   "skip",
+		"Example":     "pass",
+	}
+	if len(res.Tests) != len(outcomes) {
+		t.Errorf("expected %d results, got %d", len(outcomes), len(res.Tests))
+	}
+	for _, r := range res.Tests {
+		if outcomes[r.Name] != r.Outcome {
+			t.Errorf("%s: expected %q, got %q", r.Name, outcomes[r.Name], r.Outcome)
+		}
+	}
+	if res.Error == "" {
+		t.Error("failing test not reported")
+	}
+
+	// the benchmarks run once the tests pass, each for its own time
+	arg.Code = strings.Replace(arg.Code, `t.Error("wrong")`, "", 1)
+	res = CompileReply{}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res, res.Tests)
+	benchmarks := []string{"BenchmarkLoop", "BenchmarkSprint", "BenchmarkSleep"}
+	if res.Error != "" || len(res.Tests) != len(outcomes)+len(benchmarks) {
+		t.Fatal("benchmarks not run:", res.Error, res.Tests)
+	}
+	for i, name := range benchmarks {
+		if res.Tests[len(outcomes)+i].Name != name {
+			t.Errorf("benchmark %d: expected %s, got %s", i, name,
+				res.Tests[len(outcomes)+i].Name)
+		}
+	}
+	if !strings.Contains(res.P_Output, "coverage") {
+		t.Error("coverage not reported")
+	}
+
+	// the tests run with the time limit of the programs
+	arg = CompileArgs{Code: `import (
+	"testing"
+	"time"
+)
+
+func TestSlow(t *testing.T) { time.Sleep(5 * time.Second) }`,
+		Lang: "go", Mode: "test"}
+	res = CompileReply{}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Error, "killed") {
+		t.Error("slow test not killed:", res.Error)
+	}
+
+	arg = CompileArgs{Code: "func helper() {}", Lang: "go", Mode: "test"}
+	res = CompileReply{}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" {
+		t.Error("code without tests accepted")
+	}
+}
+
+func TestCTest(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	code := `int add(int a, int b) { return a + b; }
+
+int main(void) { return add(1, 2); }
+
+void test_add(void)
+{
+	ASSERT_EQ(add(1, 2), 3);
+	ASSERT_STR_EQ("abc", "abc");
+	ASSERT_NEAR(0.1 + 0.2, 0.3, 1e-9);
+}
+
+void test_wrong(void)
+{
+	printf("checking\n");
+	ASSERT_EQ(add(2, 2), 5);
+}
+
+void test_crash(void)
+{
+	raise(SIGSEGV);
+}
+
+void test_loop(void)
+{
+	for (;;);
+}
+`
+	outcomes := map[string]string{
+		"test_add":   "pass",
+		"test_wrong": "fail",
+		"test_crash": "fail",
+		"test_loop":  "fail",
+	}
+	messages := map[string]string{
+		"test_wrong": "prog.c:15: expected add(2, 2) == 5, got 4 and 5",
+		"test_crash": "segmentation fault",
+		"test_loop":  "timed out",
+	}
+
+	for _, lang := range []string{"c", "c89", "c99"} {
+		var res CompileReply
+		arg := CompileArgs{Code: code, Lang: lang, Mode: "test"}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res, res.Tests)
+		if len(res.Tests) != len(outcomes) {
+			t.Errorf("%s: expected %d results, got %d", lang,
+				len(outcomes), len(res.Tests))
+		}
+		for _, r := range res.Tests {
+			if outcomes[r.Name] != r.Outcome {
+				t.Errorf("%s: %s: expected %q, got %q", lang, r.Name,
+					outcomes[r.Name], r.Outcome)
+			}
+			if !strings.Contains(r.Output, messages[r.Name]) {
+				t.Errorf("%s: %s: expected %q in %q", lang, r.Name,
+					messages[r.Name], r.Output)
+			}
+		}
+	}
+
+	var res CompileReply
+	arg := CompileArgs{Code: "int main(void) { return 0; }", Lang: "c", Mode: "test"}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" {
+		t.Error("code without tests accepted")
+	}
+
+	// a file that can not be written is reported before the tests
+	// are looked for
+	res = CompileReply{}
+	arg.Files = map[string]string{"../unit.h": ""}
+	err = c.Compile(&arg, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Error, "invalid file path") {
+		t.Error("file outside the workspace not reported:", res.Error)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	cases := []struct {
+		arg  CompileArgs
+		diag lang.Diagnostic
+	}{
+		{CompileArgs{Code: "int main(void)\n{\n\tint x = \"a\";\n\treturn y;\n}", Lang: "c"},
+			lang.Diagnostic{File: "prog.c", Line: 3, Column: 10, Severity: "warning"}},
+		{CompileArgs{Code: "int main(void)\n{\n\tint x = \"a\";\n\treturn y;\n}", Lang: "c"},
+			lang.Diagnostic{File: "prog.c", Line: 4, Column: 9, Severity: "error"}},
+		{CompileArgs{Code: "int main(void)\n{\n\treturn y;\n}", Lang: "c", Mode: "asm"},
+			lang.Diagnostic{File: "prog.c", Line: 3, Column: 9, Severity: "error"}},
+		{CompileArgs{Code: "package main\n\nfunc main() {\n\tprintln(y)\n}", Lang: "go"},
+			lang.Diagnostic{File: "source.go", Line: 4, Column: 10, Severity: "error"}},
+		{CompileArgs{Code: "echo a\nif true; then\necho b\n}", Lang: "sh"},
+			lang.Diagnostic{File: "prog.sh", Line: 4, Severity: "error"}},
+	}
+	for _, tc := range cases {
+		var res CompileReply
+		err = c.Compile(&tc.arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res, res.Diagnostics)
+		found := false
+		for _, d := range res.Diagnostics {
+			d.Message, d.Option, d.Explanation, d.Fix = "", "", "", ""
+			found = found || d == tc.diag
+		}
+		if !found {
+			t.Errorf("%s: %v not reported", tc.arg.Code, tc.diag)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	cases := []struct {
+		arg CompileArgs
+		fix string
+	}{
+		{CompileArgs{Code: "int main(void) { return foo(); }", Lang: "c89"},
+			"declaring foo"},
+		{CompileArgs{Code: "int f(int x) { if (x) return 1; }\nint main(void) { return f(0); }",
+			Lang: "c", Flags: []string{"-Wreturn-type"}},
+			"every path"},
+		{CompileArgs{Code: "int main(void) { char *s = \"a\"; int *p = s; return *p; }",
+			Lang: "c"},
+			"& or *"},
+		{CompileArgs{Code: "package main\n\nimport \"os\"\n\nfunc main() {}", Lang: "go"},
+			"import of os"},
+		// the linker reports it
+		{CompileArgs{Code: "int missing(void);\nint main(void) { return missing(); }",
+			Lang: "c"},
+			"Define missing"},
+	}
+	for _, tc := range cases {
+		var res CompileReply
+		err = c.Compile(&tc.arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, d := range res.Diagnostics {
+			t.Log(d, d.Explanation, d.Fix)
+			found = found || strings.Contains(d.Fix, tc.fix) &&
+				d.Explanation != ""
+		}
+		if !found {
+			t.Errorf("%s: not explained", tc.arg.Code)
+		}
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	code := `#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+
+int main(void)
+{
+	char line[256];
+	FILE *f = fopen("/proc/self/status", "r");
+
+	printf("uid %d\n", (int)geteuid());
+	while (f && fgets(line, sizeof(line), f))
+		if (strncmp(line, "NoNewPrivs:", 11) == 0 ||
+			strncmp(line, "CapEff:", 7) == 0)
+			fputs(line, stdout);
+	return 0;
+}`
+	var res CompileReply
+	err = c.Compile(&CompileArgs{Code: code, Lang: "c"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if os.Geteuid() == 0 &&
+		!strings.Contains(res.P_Output, fmt.Sprintf("uid %d\n",
+			lang.SandboxUid)) {
+		t.Error("program runs as root")
+	}
+	if !strings.Contains(res.P_Output, "NoNewPrivs:\t1") ||
+		!strings.Contains(res.P_Output, "CapEff:\t0000000000000000") {
+		t.Error("program keeps its privileges")
+	}
+}
+
+// recordSandbox runs the commands on the host, recording their names
+type recordSandbox struct {
+	lang.Host
+	names []string
+}
+
+func (sb *recordSandbox) Exec(cmd *lang.Command) error {
+	sb.names = append(sb.names, filepath.Base(cmd.Name))
+	return sb.Host.Exec(cmd)
+}
+
+func TestSandbox(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+	s := startServer(t, exit)
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	sb := new(recordSandbox)
+	s.compSvr.GetCompiler("C").(lang.Sandboxed).SetSandbox(sb)
+
+	code := `#include <stdio.h>
+int main(void) { puts("sandboxed"); return 0; }`
+	var res CompileReply
+	err = c.Compile(&CompileArgs{Code: code, Lang: "c"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.P_Output != "sandboxed\n" {
+		t.Errorf("unexpected output %q", res.P_Output)
+	}
+	want := []string{"gcc", "prog"}
+	if res.Cached {
+		want = want[1:]
+	}
+	if strings.Join(sb.names, " ") != strings.Join(want, " ") {
+		t.Errorf("ran %v in the sandbox, want %v", sb.names, want)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	conf := DefaultConfig()
+	conf.Sandbox = lang.SandboxNamespaces
+	s, err := NewServerConfig(addr, conf)
+	if err != nil {
+		t.Skip("no namespace sandbox:", err)
+	}
+	go func() {
+		s.Wait()
+		exit <- true
+	}()
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	// neither the test nor the server it listens on can be reached,
+	// nor the sockets of the host, node may open sockets
+	port := strings.Split(addr, ":")[1]
+	cases := []CompileArgs{
+		{Code: fmt.Sprintf("test -e /proc/%d && echo pid\n"+
+			"test -d /run && echo run\necho isolated", os.Getpid()),
+			Lang: "sh"},
+		{Code: "require('net').connect(" + port + ", '127.0.0.1')" +
+			".on('connect', () => console.log('network'))" +
+			".on('error', () => console.log('isolated')); 0", Lang: "js"},
+	}
+	var res CompileReply
+	for _, arg := range cases {
+		res = CompileReply{}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(&res)
+		if !strings.HasSuffix(res.P_Output, "isolated\n") ||
+			strings.Contains(res.P_Output, "pid") ||
+			strings.Contains(res.P_Output, "run\n") ||
+			res.Isolation != lang.SandboxNamespaces {
+			t.Errorf("%s: sandbox leaks: %q in %q", arg.Lang,
+				res.P_Output, res.Isolation)
+		}
+	}
+
+	// the programs of compiled languages can not open sockets
+	res = CompileReply{}
+	err = c.Compile(&CompileArgs{Code: `int socket(int, int, int);
+int main(void) { socket(2, 1, 0); puts("socket"); return 0; }`,
+		Lang: "c"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.P_Output != "" || !strings.Contains(res.Error, "disallowed syscall") {
+		t.Errorf("socket allowed: %q %q", res.P_Output, res.Error)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	conf := DefaultConfig()
+	conf.Retention = Retention{MaxCount: 1}
+	s, err := NewServerConfig(addr, conf)
+	if err != nil {
+		t.Fatal("Failed to create server:", err)
+	}
+	go func() {
+		s.Wait()
+		exit <- true
+	}()
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		var res CompileReply
+		arg := CompileArgs{Code: "echo hello", Lang: "sh", Keep: i == 0}
+		err = c.Compile(&arg, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.compSvr.collect()
+
+	var stats StatsReply
+	err = c.Stats(struct{}{}, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(stats)
+	if stats.Kept < 1 || stats.Workspaces-stats.Kept != 1 ||
+		stats.Removed < 1 {
+		t.Error("workspaces not collected")
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	conf := DefaultConfig()
+	conf.Isolation = IsolationRequired
+	conf.Sandbox = lang.SandboxHost
+	_, err = NewServerConfig(addr, conf)
+	if err == nil {
+		t.Fatal("server runs code on the host when isolation is required")
+	}
+	t.Log(err)
+
+	conf.Isolated = []string{"C"}
+	s, err := NewServerConfig(addr, conf)
+	if err != nil {
+		t.Fatal("Failed to create server:", err)
+	}
+	go func() {
+		s.Wait()
+		exit <- true
+	}()
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c := getClient(t)
+	defer c.Close()
+
+	var list ListReply
+	err = c.List(struct{}{}, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Isolation != lang.SandboxHost {
+		t.Errorf("listed isolation %q", list.Isolation)
+	}
+	for _, comp := range list.Compilers {
+		if comp.Isolation != lang.SandboxHost {
+			t.Errorf("%s listed with isolation %q", comp.Name,
+				comp.Isolation)
+		}
+	}
+
+	var res CompileReply
+	err = c.Compile(&CompileArgs{Code: `int main(void) { return 0; }`,
+		Lang: "c"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error == "" || res.Id != "" || res.Isolation != lang.SandboxHost {
+		t.Error("C ran without a sandbox")
+	}
+
+	res = CompileReply{}
+	err = c.Compile(&CompileArgs{Code: "echo hello", Lang: "sh"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.P_Output != "hello\n" || res.Isolation != lang.SandboxHost {
+		t.Error("sh refused")
+	}
+
+	var jres JudgeReply
+	err = c.Judge(&JudgeArgs{CompileArgs: CompileArgs{Code: "echo hello",
+		Lang: "sh"}}, &jres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jres.Isolation != lang.SandboxHost {
+		t.Errorf("judged with isolation %q", jres.Isolation)
+	}
+}
+
+func TestIsolationPlugin(t *testing.T) {
+	var err error
+	var exit chan bool = make(chan bool)
+
+	defer installPlugin(t)()
+
+	// a trusted plugin isolates the code itself
+	conf := DefaultConfig()
+	conf.Isolation = IsolationRequired
+	conf.Sandbox = lang.SandboxNamespaces
+	conf.Trusted = []string{"fake"}
+	s, err := NewServerConfig(addr, conf)
+	if err != nil && strings.Contains(err.Error(), "namespaces sandbox") {
+		t.Skip("namespaces sandbox not available:", err)
+	}
+	if err != nil {
+		t.Fatal("Failed to create server:", err)
+	}
+	go func() {
+		s.Wait()
+		exit <- true
+	}()
+
+	c := getClient(t)
+	var res CompileReply
+	err = c.Compile(&CompileArgs{Code: "args", Lang: "fake"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error != "" || res.P_Output == "" {
+		t.Error("trusted plugin refused")
+	}
+	c.Close()
+	stopServer(s)
+	<-exit
+
+	// the others run the code on the host
+	conf.Trusted = nil
+	_, err = NewServerConfig(addr, conf)
+	if err == nil ||
+		!strings.Contains(strings.ToLower(err.Error()), "fake") {
+		t.Fatal("server started with a plugin running code on the host:",
+			err)
+	}
+	t.Log(err)
+
+	conf.Isolated = []string{"fake"}
+	s, err = NewServerConfig(addr, conf)
+	if err != nil {
+		t.Fatal("Failed to create server:", err)
+	}
+	go func() {
+		s.Wait()
+		exit <- true
+	}()
+	defer func() {
+		stopServer(s)
+		<-exit
+	}()
+
+	c = getClient(t)
+	defer c.Close()
+	res = CompileReply{}
+	err = c.Compile(&CompileArgs{Code: "args", Lang: "fake"}, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(&res)
+	if res.Error == "" || res.P_Output != "" {
+		t.Error("plugin named in Isolated ran on the host")
+	}
+}
+
 func TestBench(t *testing.T) {
 	t.SkipNow()
 	var wg sync.WaitGroup
@@ -262,7 +1999,7 @@ func TestBench(t *testing.T) {
 				s := getClient(t)
 				defer s.Close()
 				var res CompileReply
-				arg := CompileArgs{code, "c"}
+				arg := CompileArgs{Code: code, Lang: "c"}
 				err := s.Compile(&arg, &res)
 
 				if err != nil {
@@ -14,10 +14,14 @@ func init() {
 }
 
 func NewServer(addr string) (*Server, error) {
+	return NewServerConfig(addr, DefaultConfig())
+}
+
+func NewServerConfig(addr string, conf *Config) (*Server, error) {
 	var err error
 	s := new(Server)
 
-	s.compSvr = NewCompilerServer()
+	s.compSvr = NewCompilerServer(conf)
 
 	err = s.compSvr.Init()
 	if err != nil {